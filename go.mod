@@ -4,13 +4,14 @@ go 1.19
 
 require (
 	github.com/Shopify/sarama v1.38.1
-	github.com/influxdata/influxdb1-client v0.0.0-20220302092344-a9ab5670611c
+	github.com/golang/snappy v0.0.4
 	github.com/kubernetes/helm v2.17.0+incompatible
 	github.com/mstoykov/envconfig v1.4.1-0.20220114105314-765c6d8c76f1
 	github.com/sirupsen/logrus v1.9.0
 	github.com/stretchr/testify v1.8.2
 	github.com/xdg/scram v1.0.5
 	go.k6.io/k6 v0.45.1
+	google.golang.org/protobuf v1.31.0
 	gopkg.in/guregu/null.v3 v3.5.0
 )
 
@@ -21,7 +22,6 @@ require (
 	github.com/eapache/queue v1.1.0 // indirect
 	github.com/fatih/color v1.15.0 // indirect
 	github.com/ghodss/yaml v1.0.0 // indirect
-	github.com/golang/snappy v0.0.4 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/hashicorp/go-uuid v1.0.3 // indirect
@@ -0,0 +1,452 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.k6.io/k6/lib/fsext"
+	"gopkg.in/guregu/null.v3"
+)
+
+const (
+	// mskIAMService is the SigV4 service of the MSK IAM auth tokens.
+	mskIAMService = "kafka-cluster"
+	// mskIAMTokenLifetime is how long a signed MSK IAM token is valid.
+	mskIAMTokenLifetime = 15 * time.Minute
+	// mskIAMUserAgent is added to the signed URL, so the brokers can tell
+	// which client authenticated.
+	mskIAMUserAgent = "xk6-output-kafka"
+
+	awsSigningAlgorithm = "AWS4-HMAC-SHA256"
+	awsTimeFormat       = "20060102T150405Z"
+	awsDateFormat       = "20060102"
+
+	// awsCredentialsRefreshMargin is how long before they expire temporary
+	// credentials are requested again.
+	awsCredentialsRefreshMargin = 5 * time.Minute
+)
+
+type awsConfig struct {
+	Region  null.String `json:"region" envconfig:"K6_KAFKA_AWS_REGION"`
+	Profile null.String `json:"profile" envconfig:"K6_KAFKA_AWS_PROFILE"`
+}
+
+func (c awsConfig) Apply(cfg awsConfig) awsConfig {
+	if cfg.Region.Valid {
+		c.Region = cfg.Region
+	}
+	if cfg.Profile.Valid {
+		c.Profile = cfg.Profile
+	}
+	return c
+}
+
+// awsParseMap parses a map[string]interface{} into an awsConfig
+func awsParseMap(m map[string]interface{}) (awsConfig, error) {
+	c := awsConfig{}
+	if v, ok := m["region"].(string); ok {
+		c.Region = null.StringFrom(v)
+		delete(m, "region")
+	}
+	if v, ok := m["profile"].(string); ok {
+		c.Profile = null.StringFrom(v)
+		delete(m, "profile")
+	}
+	if len(m) > 0 {
+		return c, errors.New("Unknown or unparsed options '" + mapToString(m) + "'")
+	}
+	return c, nil
+}
+
+func (c Config) validateMSKIAM() error {
+	if c.AuthMechanism.String != "aws-msk-iam" {
+		return nil
+	}
+	if !c.SSL.Bool {
+		return errors.New("the aws-msk-iam auth mechanism requires ssl=true")
+	}
+	return c.requireVersion(sarama.V2_0_0_0, "aws-msk-iam")
+}
+
+// awsCredentials are the credentials requests are signed with.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Expires is when temporary credentials expire, it's zero for long-term ones.
+	Expires time.Time
+}
+
+type awsCredentialsProvider interface {
+	retrieve() (awsCredentials, error)
+}
+
+// newAWSCredentialsProvider returns the first of the standard AWS credential
+// sources that's configured: the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// environment variables, a web identity token to exchange for role
+// credentials (AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE), or a profile of
+// the shared credentials file.
+func newAWSCredentialsProvider(c awsConfig, env map[string]string, fs fsext.Fs, region string) awsCredentialsProvider {
+	if env["AWS_ACCESS_KEY_ID"] != "" && env["AWS_SECRET_ACCESS_KEY"] != "" && !c.Profile.Valid {
+		return staticAWSCredentials(awsCredentials{
+			AccessKeyID:     env["AWS_ACCESS_KEY_ID"],
+			SecretAccessKey: env["AWS_SECRET_ACCESS_KEY"],
+			SessionToken:    env["AWS_SESSION_TOKEN"],
+		})
+	}
+
+	if env["AWS_ROLE_ARN"] != "" && env["AWS_WEB_IDENTITY_TOKEN_FILE"] != "" && !c.Profile.Valid {
+		sessionName := env["AWS_ROLE_SESSION_NAME"]
+		if sessionName == "" {
+			sessionName = "k6-" + strconv.FormatInt(time.Now().Unix(), 10)
+		}
+		return &webIdentityAWSCredentials{
+			fs:          fs,
+			roleARN:     env["AWS_ROLE_ARN"],
+			tokenFile:   env["AWS_WEB_IDENTITY_TOKEN_FILE"],
+			sessionName: sessionName,
+			stsURL:      "https://sts." + region + ".amazonaws.com/",
+			httpClient:  &http.Client{Timeout: oauthRequestTimeout},
+			now:         time.Now,
+		}
+	}
+
+	profile := env["AWS_PROFILE"]
+	if c.Profile.Valid {
+		profile = c.Profile.String
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	file := env["AWS_SHARED_CREDENTIALS_FILE"]
+	if file == "" {
+		file = path.Join(env["HOME"], ".aws", "credentials")
+	}
+	return &sharedAWSCredentials{fs: fs, file: file, profile: profile}
+}
+
+type staticAWSCredentials awsCredentials
+
+func (s staticAWSCredentials) retrieve() (awsCredentials, error) {
+	return awsCredentials(s), nil
+}
+
+// sharedAWSCredentials reads a profile of the shared credentials file, every
+// time so rotated credentials are picked up.
+type sharedAWSCredentials struct {
+	fs      fsext.Fs
+	file    string
+	profile string
+}
+
+func (s *sharedAWSCredentials) retrieve() (awsCredentials, error) {
+	b, err := fsext.ReadFile(s.fs, s.file)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials in the environment, and couldn't read "+
+			"the shared credentials file: %w", err)
+	}
+
+	var credentials awsCredentials
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+			continue
+		case line[0] == '[' && line[len(line)-1] == ']':
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		case section != s.profile:
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			credentials.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			credentials.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			credentials.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("the %s profile of %s doesn't have AWS credentials", s.profile, s.file)
+	}
+	return credentials, nil
+}
+
+// webIdentityAWSCredentials exchanges a web identity token, like the ones of
+// EKS service accounts, for the credentials of a role. The credentials are
+// reused until they're about to expire.
+type webIdentityAWSCredentials struct {
+	fs          fsext.Fs
+	roleARN     string
+	tokenFile   string
+	sessionName string
+	stsURL      string
+	httpClient  *http.Client
+	now         func() time.Time
+
+	mu          sync.Mutex
+	credentials awsCredentials
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+type stsErrorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+func (s *webIdentityAWSCredentials) retrieve() (awsCredentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.credentials.AccessKeyID != "" && s.now().Add(awsCredentialsRefreshMargin).Before(s.credentials.Expires) {
+		return s.credentials, nil
+	}
+
+	token, err := fsext.ReadFile(s.fs, s.tokenFile)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("couldn't read the web identity token file: %w", err)
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {s.roleARN},
+		"RoleSessionName":  {s.sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oauthRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.stsURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("assuming the %s role failed: %w", s.roleARN, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var stsErr stsErrorResponse
+		_ = xml.Unmarshal(body, &stsErr)
+		return awsCredentials{}, fmt.Errorf("assuming the %s role failed with status %d: %s %s",
+			s.roleARN, resp.StatusCode, stsErr.Code, stsErr.Message)
+	}
+	var response assumeRoleWithWebIdentityResponse
+	if err := xml.Unmarshal(body, &response); err != nil {
+		return awsCredentials{}, fmt.Errorf("unexpected AssumeRoleWithWebIdentity response: %w", err)
+	}
+	s.credentials = awsCredentials{
+		AccessKeyID:     response.Credentials.AccessKeyID,
+		SecretAccessKey: response.Credentials.SecretAccessKey,
+		SessionToken:    response.Credentials.SessionToken,
+		Expires:         response.Credentials.Expiration,
+	}
+	return s.credentials, nil
+}
+
+// mskIAMTokenSource generates the OAUTHBEARER tokens of the MSK IAM auth: a
+// SigV4 presigned kafka-cluster:Connect URL, base64url encoded.
+type mskIAMTokenSource struct {
+	region      string
+	credentials awsCredentialsProvider
+	now         func() time.Time
+}
+
+func (s *mskIAMTokenSource) fetchToken() (string, time.Time, error) {
+	credentials, err := s.credentials.retrieve()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	signTime := s.now().UTC()
+	token := mskIAMToken(s.region, credentials, signTime)
+
+	expiry := signTime.Add(mskIAMTokenLifetime)
+	if !credentials.Expires.IsZero() && credentials.Expires.Before(expiry) {
+		expiry = credentials.Expires
+	}
+	return token, expiry, nil
+}
+
+// mskIAMToken returns the MSK IAM auth token for the region, signed with the
+// credentials at signTime.
+func mskIAMToken(region string, credentials awsCredentials, signTime time.Time) string {
+	query := url.Values{"Action": {"kafka-cluster:Connect"}}
+	emptyPayloadHash := sha256.Sum256(nil)
+	signedURL := presignAWSURL(presignRequest{
+		host:        "kafka." + region + ".amazonaws.com",
+		path:        "/",
+		query:       query,
+		payloadHash: hex.EncodeToString(emptyPayloadHash[:]),
+		service:     mskIAMService,
+		region:      region,
+		expires:     mskIAMTokenLifetime,
+		signTime:    signTime,
+	}, credentials)
+	signedURL += "&User-Agent=" + awsURIEncode(mskIAMUserAgent)
+	return base64.RawURLEncoding.EncodeToString([]byte(signedURL))
+}
+
+// presignRequest is a GET request to presign with SigV4 query parameters.
+type presignRequest struct {
+	host        string
+	path        string
+	query       url.Values
+	payloadHash string
+	service     string
+	region      string
+	expires     time.Duration
+	signTime    time.Time
+}
+
+// presignAWSURL signs the request with the SigV4 query parameters, only the
+// host header is signed, and returns its URL.
+func presignAWSURL(r presignRequest, credentials awsCredentials) string {
+	date := r.signTime.Format(awsDateFormat)
+	scope := date + "/" + r.region + "/" + r.service + "/aws4_request"
+
+	query := url.Values{}
+	for k, v := range r.query {
+		query[k] = v
+	}
+	query.Set("X-Amz-Algorithm", awsSigningAlgorithm)
+	query.Set("X-Amz-Credential", credentials.AccessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", r.signTime.Format(awsTimeFormat))
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(r.expires/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if credentials.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+	canonicalQuery := awsCanonicalQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		r.path,
+		canonicalQuery,
+		"host:" + r.host + "\n",
+		"host",
+		r.payloadHash,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		awsSigningAlgorithm,
+		r.signTime.Format(awsTimeFormat),
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), date)
+	key = hmacSHA256(key, r.region)
+	key = hmacSHA256(key, r.service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return "https://" + r.host + r.path + "?" + canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+// awsCanonicalQuery encodes the query with the keys sorted, as SigV4 expects.
+func awsCanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, awsURIEncode(k)+"="+awsURIEncode(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode percent-encodes everything but the unreserved characters.
+func awsURIEncode(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// newMSKIAMTokenProvider returns the sarama.AccessTokenProvider of the
+// aws-msk-iam auth mechanism, the region and credentials are looked up in the
+// config and then in the standard AWS environment variables.
+func newMSKIAMTokenProvider(c awsConfig, env map[string]string, fs fsext.Fs) (*oauthTokenProvider, error) {
+	region := c.Region.String
+	for _, key := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region == "" {
+			region = env[key]
+		}
+	}
+	if region == "" {
+		return nil, errors.New("the aws-msk-iam auth mechanism requires aws.region or the AWS_REGION environment variable")
+	}
+	return &oauthTokenProvider{
+		source: &mskIAMTokenSource{
+			region:      region,
+			credentials: newAWSCredentialsProvider(c, env, fs, region),
+			now:         time.Now,
+		},
+		now: time.Now,
+	}, nil
+}
@@ -0,0 +1,155 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/Shopify/sarama"
+	"go.k6.io/k6/metrics"
+)
+
+// The supported values of the batch option.
+const (
+	batchNone  = "none"
+	batchLines = "lines"
+	batchArray = "array"
+)
+
+// headerRecordCount is the header with the number of samples in a batched message.
+const headerRecordCount = "k6-record-count"
+
+func (c Config) validateBatch() error {
+	switch c.Batch.String {
+	case "", batchNone:
+		return nil
+	case batchLines:
+		if c.Format.String != "json" && c.Format.String != "influxdb" {
+			return fmt.Errorf("batch=%s is only supported with the json and influxdb formats", batchLines)
+		}
+	case batchArray:
+		if c.Format.String != "json" {
+			return fmt.Errorf("batch=%s is only supported with the json format", batchArray)
+		}
+	default:
+		return fmt.Errorf("invalid batch (%s), it should be one of none, lines or array", c.Batch.String)
+	}
+
+	if c.BatchMaxBytes.Valid && c.BatchMaxBytes.Int64 <= 0 {
+		return fmt.Errorf("batchMaxBytes should be positive but was %d", c.BatchMaxBytes.Int64)
+	}
+	if c.MaxMessageBytes.Valid && c.BatchMaxBytes.Int64 > c.MaxMessageBytes.Int64 {
+		return fmt.Errorf("batchMaxBytes (%d) can't be larger than maxMessageBytes (%d)",
+			c.BatchMaxBytes.Int64, c.MaxMessageBytes.Int64)
+	}
+	return c.requireVersion(sarama.V0_11_0_0, "batching")
+}
+
+// batchMaxBytes returns the maximum size of a batched message, which can't be
+// larger than the maximum message size of the producer.
+func (c Config) batchMaxBytes() int {
+	maxBytes := sarama.NewConfig().Producer.MaxMessageBytes
+	if c.MaxMessageBytes.Valid {
+		maxBytes = int(c.MaxMessageBytes.Int64)
+	}
+	if c.BatchMaxBytes.Valid && int(c.BatchMaxBytes.Int64) < maxBytes {
+		maxBytes = int(c.BatchMaxBytes.Int64)
+	}
+	return maxBytes
+}
+
+// messageBatch is a message with multiple samples in the making.
+type messageBatch struct {
+	key      sarama.Encoder
+	value    []byte
+	samples  []metrics.Sample
+	overhead int
+}
+
+// packMessages packs the formatted samples into as few messages as possible,
+// framed according to the batch option. Samples with different keys are never
+// packed together and every message stays within batchMaxBytes, unless a
+// single sample is larger than that.
+func (o *Output) packMessages(
+	topic string, samples []metrics.Sample, formattedSamples []string, headers []sarama.RecordHeader,
+) []*sarama.ProducerMessage {
+	maxBytes := o.Config.batchMaxBytes()
+	open, separator, closing := "", "\n", ""
+	if o.Config.Batch.String == batchArray {
+		open, separator, closing = "[", ",", "]"
+	}
+
+	var messages []*sarama.ProducerMessage
+	emit := func(b *messageBatch) {
+		b.value = append(b.value, closing...)
+		batchHeaders := make([]sarama.RecordHeader, 0, len(headers)+1)
+		batchHeaders = append(batchHeaders, headers...)
+		batchHeaders = append(batchHeaders, sarama.RecordHeader{
+			Key:   []byte(headerRecordCount),
+			Value: []byte(strconv.Itoa(len(b.samples))),
+		})
+		messages = append(messages, &sarama.ProducerMessage{
+			Topic:     topic,
+			Key:       b.key,
+			Value:     sarama.ByteEncoder(b.value),
+			Headers:   batchHeaders,
+			Timestamp: messageTimestamp(o.Config.Timestamp.String, b.samples),
+			Metadata:  o.queue.priority(b.samples),
+		})
+	}
+
+	var order []string
+	batches := make(map[string]*messageBatch)
+	for i, formattedSample := range formattedSamples {
+		key := o.keys.forSample(samples[i])
+		var keyString string
+		if key != nil {
+			b, _ := key.Encode()
+			keyString = string(b)
+		}
+
+		b, ok := batches[keyString]
+		if ok && b.overhead+len(b.value)+len(separator)+len(formattedSample)+len(closing) > maxBytes {
+			emit(b)
+			ok = false
+		}
+		if !ok {
+			b = &messageBatch{key: key, value: []byte(open)}
+			// the size of the message without the value, including the record count header
+			b.overhead = (&sarama.ProducerMessage{Key: key, Headers: headers}).ByteSize(2) +
+				len(headerRecordCount) + 2*binary.MaxVarintLen32 + len(strconv.Itoa(len(formattedSamples)))
+			if _, seen := batches[keyString]; !seen {
+				order = append(order, keyString)
+			}
+			batches[keyString] = b
+		} else {
+			b.value = append(b.value, separator...)
+		}
+		b.value = append(b.value, formattedSample...)
+		b.samples = append(b.samples, samples[i])
+	}
+	for _, keyString := range order {
+		emit(batches[keyString])
+	}
+	return messages
+}
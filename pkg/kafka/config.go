@@ -24,6 +24,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/mstoykov/envconfig"
@@ -42,17 +43,58 @@ type Config struct {
 
 	// Samples.
 	Topic                 null.String        `json:"topic" envconfig:"K6_KAFKA_TOPIC"`
+	Routes                []string           `json:"routes" envconfig:"K6_KAFKA_ROUTES"`
+	Key                   null.String        `json:"key" envconfig:"K6_KAFKA_KEY"`
+	KeyTags               []string           `json:"keyTags" envconfig:"K6_KAFKA_KEY_TAGS"`
+	Headers               null.Bool          `json:"headers" envconfig:"K6_KAFKA_HEADERS"`
+	Timestamp             null.String        `json:"timestamp" envconfig:"K6_KAFKA_TIMESTAMP"`
+	Batch                 null.String        `json:"batch" envconfig:"K6_KAFKA_BATCH"`
+	BatchMaxBytes         null.Int           `json:"batchMaxBytes" envconfig:"K6_KAFKA_BATCH_MAX_BYTES"`
+	MaxMessageBytes       null.Int           `json:"maxMessageBytes" envconfig:"K6_KAFKA_MAX_MESSAGE_BYTES"`
+	Compression           null.String        `json:"compression" envconfig:"K6_KAFKA_COMPRESSION"`
+	CompressionLevel      null.Int           `json:"compressionLevel" envconfig:"K6_KAFKA_COMPRESSION_LEVEL"`
+	Acks                  null.String        `json:"acks" envconfig:"K6_KAFKA_ACKS"`
+	Idempotent            null.Bool          `json:"idempotent" envconfig:"K6_KAFKA_IDEMPOTENT"`
+	RetryMax              null.Int           `json:"retryMax" envconfig:"K6_KAFKA_RETRY_MAX"`
+	RetryBackoff          types.NullDuration `json:"retryBackoff" envconfig:"K6_KAFKA_RETRY_BACKOFF"`
+	MaxOpenRequests       null.Int           `json:"maxOpenRequests" envconfig:"K6_KAFKA_MAX_OPEN_REQUESTS"`
+	Timeout               types.NullDuration `json:"timeout" envconfig:"K6_KAFKA_TIMEOUT"`
+	Transactional         null.Bool          `json:"transactional" envconfig:"K6_KAFKA_TRANSACTIONAL"`
+	TransactionalIDPrefix null.String        `json:"transactionalIDPrefix" envconfig:"K6_KAFKA_TRANSACTIONAL_ID_PREFIX"`
+	TestRunID             null.String        `json:"testRunID" envconfig:"K6_KAFKA_TEST_RUN_ID"`
 	User                  null.String        `json:"user" envconfig:"K6_KAFKA_SASL_USER"`
 	Password              null.String        `json:"password" envconfig:"K6_KAFKA_SASL_PASSWORD"`
+	UserFile              null.String        `json:"userFile" envconfig:"K6_KAFKA_SASL_USER_FILE"`
+	PasswordFile          null.String        `json:"passwordFile" envconfig:"K6_KAFKA_SASL_PASSWORD_FILE"`
 	AuthMechanism         null.String        `json:"authMechanism" envconfig:"K6_KAFKA_AUTH_MECHANISM"`
 	Format                null.String        `json:"format" envconfig:"K6_KAFKA_FORMAT"`
 	PushInterval          types.NullDuration `json:"pushInterval" envconfig:"K6_KAFKA_PUSH_INTERVAL"`
+	FlushMaxSamples       null.Int           `json:"flushMaxSamples" envconfig:"K6_KAFKA_FLUSH_MAX_SAMPLES"`
+	FlushMaxBytes         null.Int           `json:"flushMaxBytes" envconfig:"K6_KAFKA_FLUSH_MAX_BYTES"`
 	Version               null.String        `json:"version" envconfig:"K6_KAFKA_VERSION"`
 	SSL                   null.Bool          `json:"ssl" envconfig:"K6_KAFKA_SSL"`
 	InsecureSkipTLSVerify null.Bool          `json:"insecureSkipTLSVerify" envconfig:"K6_KAFKA_INSECURE_SKIP_TLS_VERIFY"`
+	CAFile                null.String        `json:"caFile" envconfig:"K6_KAFKA_CA_FILE"`
+	CertFile              null.String        `json:"certFile" envconfig:"K6_KAFKA_CERT_FILE"`
+	KeyFile               null.String        `json:"keyFile" envconfig:"K6_KAFKA_KEY_FILE"`
+	KeyPassphrase         null.String        `json:"keyPassphrase" envconfig:"K6_KAFKA_KEY_PASSPHRASE"`
+	KeyPassphraseFile     null.String        `json:"keyPassphraseFile" envconfig:"K6_KAFKA_KEY_PASSPHRASE_FILE"`
+	ServerName            null.String        `json:"serverName" envconfig:"K6_KAFKA_SERVER_NAME"`
+	TLSMinVersion         null.String        `json:"tlsMinVersion" envconfig:"K6_KAFKA_TLS_MIN_VERSION"`
 	LogError              null.Bool          `json:"logError" envconfig:"K6_KAFKA_LOG_ERROR"`
+	DeliveryReport        null.String        `json:"deliveryReport" envconfig:"K6_KAFKA_DELIVERY_REPORT"`
 
-	InfluxDBConfig influxdbConfig `json:"influxdb"`
+	InfluxDBConfig influxdbConfig       `json:"influxdb"`
+	SchemaRegistry schemaRegistryConfig `json:"schemaRegistry"`
+	OTLPConfig     otlpConfig           `json:"otlp"`
+	OAuth          oauthConfig          `json:"oauth"`
+	GSSAPI         gssapiConfig         `json:"gssapi"`
+	AWS            awsConfig            `json:"aws"`
+	Spool          spoolConfig          `json:"spool"`
+	Queue          queueConfig          `json:"queue"`
+	StopTest       stopTestConfig       `json:"stopTest"`
+	Preflight      preflightConfig      `json:"preflight"`
+	CreateTopic    createTopicConfig    `json:"createTopic"`
 }
 
 // NewConfig creates a new Config instance with default values for some fields.
@@ -74,15 +116,16 @@ func (c Config) Apply(cfg Config) Config {
 	if len(cfg.Brokers) > 0 {
 		c.Brokers = cfg.Brokers
 	}
-	if cfg.Format.Valid {
-		c.Format = cfg.Format
-	}
-	if cfg.Topic.Valid {
-		c.Topic = cfg.Topic
-	}
+	applyMessages(&c, cfg)
 	if cfg.PushInterval.Valid {
 		c.PushInterval = cfg.PushInterval
 	}
+	if cfg.FlushMaxSamples.Valid {
+		c.FlushMaxSamples = cfg.FlushMaxSamples
+	}
+	if cfg.FlushMaxBytes.Valid {
+		c.FlushMaxBytes = cfg.FlushMaxBytes
+	}
 	if cfg.AuthMechanism.Valid {
 		c.AuthMechanism = cfg.AuthMechanism
 	}
@@ -92,25 +135,143 @@ func (c Config) Apply(cfg Config) Config {
 	if cfg.Password.Valid {
 		c.Password = cfg.Password
 	}
-	if cfg.Version.Valid {
-		c.Version = cfg.Version
+	if cfg.UserFile.Valid {
+		c.UserFile = cfg.UserFile
 	}
-	if cfg.SSL.Valid {
-		c.SSL = cfg.SSL
+	if cfg.PasswordFile.Valid {
+		c.PasswordFile = cfg.PasswordFile
 	}
-
-	if cfg.InsecureSkipTLSVerify.Valid {
-		c.InsecureSkipTLSVerify = cfg.InsecureSkipTLSVerify
+	if cfg.Version.Valid {
+		c.Version = cfg.Version
 	}
+	applyProducer(&c, cfg)
+	applyTLS(&c, cfg)
 
 	if cfg.LogError.Valid {
 		c.LogError = cfg.LogError
 	}
+	if cfg.DeliveryReport.Valid {
+		c.DeliveryReport = cfg.DeliveryReport
+	}
 
 	c.InfluxDBConfig = c.InfluxDBConfig.Apply(cfg.InfluxDBConfig)
+	c.SchemaRegistry = c.SchemaRegistry.Apply(cfg.SchemaRegistry)
+	c.OTLPConfig = c.OTLPConfig.Apply(cfg.OTLPConfig)
+	c.OAuth = c.OAuth.Apply(cfg.OAuth)
+	c.GSSAPI = c.GSSAPI.Apply(cfg.GSSAPI)
+	c.AWS = c.AWS.Apply(cfg.AWS)
+	c.Spool = c.Spool.Apply(cfg.Spool)
+	c.Queue = c.Queue.Apply(cfg.Queue)
+	c.StopTest = c.StopTest.Apply(cfg.StopTest)
+	c.Preflight = c.Preflight.Apply(cfg.Preflight)
+	c.CreateTopic = c.CreateTopic.Apply(cfg.CreateTopic)
 	return c
 }
 
+// applyMessages applies the options about what the messages are made of and
+// where they go.
+func applyMessages(c *Config, cfg Config) {
+	if cfg.Format.Valid {
+		c.Format = cfg.Format
+	}
+	if cfg.Topic.Valid {
+		c.Topic = cfg.Topic
+	}
+	if len(cfg.Routes) > 0 {
+		c.Routes = cfg.Routes
+	}
+	if cfg.Key.Valid {
+		c.Key = cfg.Key
+	}
+	if len(cfg.KeyTags) > 0 {
+		c.KeyTags = cfg.KeyTags
+	}
+	if cfg.Headers.Valid {
+		c.Headers = cfg.Headers
+	}
+	if cfg.TestRunID.Valid {
+		c.TestRunID = cfg.TestRunID
+	}
+	if cfg.Timestamp.Valid {
+		c.Timestamp = cfg.Timestamp
+	}
+	if cfg.Batch.Valid {
+		c.Batch = cfg.Batch
+	}
+	if cfg.BatchMaxBytes.Valid {
+		c.BatchMaxBytes = cfg.BatchMaxBytes
+	}
+	if cfg.MaxMessageBytes.Valid {
+		c.MaxMessageBytes = cfg.MaxMessageBytes
+	}
+}
+
+// applyProducer applies the options about how the producer compresses and
+// delivers the messages.
+func applyProducer(c *Config, cfg Config) {
+	if cfg.Compression.Valid {
+		c.Compression = cfg.Compression
+	}
+	if cfg.CompressionLevel.Valid {
+		c.CompressionLevel = cfg.CompressionLevel
+	}
+	if cfg.Acks.Valid {
+		c.Acks = cfg.Acks
+	}
+	if cfg.Idempotent.Valid {
+		c.Idempotent = cfg.Idempotent
+	}
+	if cfg.RetryMax.Valid {
+		c.RetryMax = cfg.RetryMax
+	}
+	if cfg.RetryBackoff.Valid {
+		c.RetryBackoff = cfg.RetryBackoff
+	}
+	if cfg.MaxOpenRequests.Valid {
+		c.MaxOpenRequests = cfg.MaxOpenRequests
+	}
+	if cfg.Timeout.Valid {
+		c.Timeout = cfg.Timeout
+	}
+	if cfg.Transactional.Valid {
+		c.Transactional = cfg.Transactional
+	}
+	if cfg.TransactionalIDPrefix.Valid {
+		c.TransactionalIDPrefix = cfg.TransactionalIDPrefix
+	}
+}
+
+// applyTLS applies the options about the TLS connection to the brokers.
+func applyTLS(c *Config, cfg Config) {
+	if cfg.SSL.Valid {
+		c.SSL = cfg.SSL
+	}
+	if cfg.InsecureSkipTLSVerify.Valid {
+		c.InsecureSkipTLSVerify = cfg.InsecureSkipTLSVerify
+	}
+	if cfg.CAFile.Valid {
+		c.CAFile = cfg.CAFile
+	}
+	if cfg.CertFile.Valid {
+		c.CertFile = cfg.CertFile
+	}
+	if cfg.KeyFile.Valid {
+		c.KeyFile = cfg.KeyFile
+	}
+	if cfg.KeyPassphrase.Valid {
+		c.KeyPassphrase = cfg.KeyPassphrase
+	}
+	if cfg.KeyPassphraseFile.Valid {
+		c.KeyPassphraseFile = cfg.KeyPassphraseFile
+	}
+	if cfg.ServerName.Valid {
+		c.ServerName = cfg.ServerName
+	}
+	if cfg.TLSMinVersion.Valid {
+		c.TLSMinVersion = cfg.TLSMinVersion
+	}
+}
+
 // ParseArg takes an arg string and converts it to a config
 func ParseArg(arg string) (Config, error) {
 	c := Config{}
@@ -119,38 +280,32 @@ func ParseArg(arg string) (Config, error) {
 		return c, err
 	}
 
-	if v, ok := params["influxdb"].(map[string]interface{}); ok {
-		influxConfig, err := influxdbParseMap(v)
-		if err != nil {
-			return c, err
-		}
-		c.InfluxDBConfig = c.InfluxDBConfig.Apply(influxConfig)
+	if err := parseArgSections(&c, params); err != nil {
+		return c, err
 	}
-	delete(params, "influxdb")
 
-	if v, ok := params["pushInterval"].(string); ok {
-		err := c.PushInterval.UnmarshalText([]byte(v))
-		if err != nil {
-			return c, err
-		}
-		delete(params, "pushInterval")
+	if err := parseArgFlush(&c, params); err != nil {
+		return c, err
+	}
+	parseArgMessages(&c, params)
+
+	if err := parseArgProducer(&c, params); err != nil {
+		return c, err
 	}
+
 	if v, ok := params["version"].(string); ok {
 		c.Version = null.StringFrom(v)
 		delete(params, "version")
 	}
-	if v, ok := params["ssl"].(bool); ok {
-		c.SSL = null.BoolFrom(v)
-		delete(params, "ssl")
-	}
-	if v, ok := params["insecureSkipTLSVerify"].(bool); ok {
-		c.InsecureSkipTLSVerify = null.BoolFrom(v)
-		delete(params, "insecureSkipTLSVerify")
-	}
+	parseArgTLS(&c, params)
 	if v, ok := params["logError"].(bool); ok {
 		c.LogError = null.BoolFrom(v)
 		delete(params, "logError")
 	}
+	if v, ok := params["deliveryReport"].(string); ok {
+		c.DeliveryReport = null.StringFrom(v)
+		delete(params, "deliveryReport")
+	}
 	if v, ok := params["authMechanism"].(string); ok {
 		c.AuthMechanism = null.StringFrom(v)
 		delete(params, "authMechanism")
@@ -163,14 +318,13 @@ func ParseArg(arg string) (Config, error) {
 		c.Password = null.StringFrom(v)
 		delete(params, "password")
 	}
-	if v, ok := params["topic"].(string); ok {
-		c.Topic = null.StringFrom(v)
-		delete(params, "topic")
+	if v, ok := params["userFile"].(string); ok {
+		c.UserFile = null.StringFrom(v)
+		delete(params, "userFile")
 	}
-	if v, ok := params["format"].(string); ok {
-		c.Format = null.StringFrom(v)
-
-		delete(params, "format")
+	if v, ok := params["passwordFile"].(string); ok {
+		c.PasswordFile = null.StringFrom(v)
+		delete(params, "passwordFile")
 	}
 	if v, ok := params["brokers"].(string); ok {
 		c.Brokers = []string{v}
@@ -188,6 +342,290 @@ func ParseArg(arg string) (Config, error) {
 	return c, nil
 }
 
+// parseArgSections parses the nested option groups, like influxdb.tagsAsFields,
+// out of params.
+func parseArgSections(c *Config, params map[string]interface{}) error {
+	if v, ok := params["influxdb"].(map[string]interface{}); ok {
+		influxConfig, err := influxdbParseMap(v)
+		if err != nil {
+			return err
+		}
+		c.InfluxDBConfig = c.InfluxDBConfig.Apply(influxConfig)
+	}
+	delete(params, "influxdb")
+
+	if v, ok := params["schemaRegistry"].(map[string]interface{}); ok {
+		registryConfig, err := schemaRegistryParseMap(v)
+		if err != nil {
+			return err
+		}
+		c.SchemaRegistry = c.SchemaRegistry.Apply(registryConfig)
+	}
+	delete(params, "schemaRegistry")
+
+	if v, ok := params["otlp"].(map[string]interface{}); ok {
+		otlpConfig, err := otlpParseMap(v)
+		if err != nil {
+			return err
+		}
+		c.OTLPConfig = c.OTLPConfig.Apply(otlpConfig)
+	}
+	delete(params, "otlp")
+
+	if v, ok := params["oauth"].(map[string]interface{}); ok {
+		oauthConfig, err := oauthParseMap(v)
+		if err != nil {
+			return err
+		}
+		c.OAuth = c.OAuth.Apply(oauthConfig)
+	}
+	delete(params, "oauth")
+
+	if v, ok := params["gssapi"].(map[string]interface{}); ok {
+		gssapiConfig, err := gssapiParseMap(v)
+		if err != nil {
+			return err
+		}
+		c.GSSAPI = c.GSSAPI.Apply(gssapiConfig)
+	}
+	delete(params, "gssapi")
+
+	if v, ok := params["aws"].(map[string]interface{}); ok {
+		awsConfig, err := awsParseMap(v)
+		if err != nil {
+			return err
+		}
+		c.AWS = c.AWS.Apply(awsConfig)
+	}
+	delete(params, "aws")
+
+	return parseArgDeliverySections(c, params)
+}
+
+// parseArgDeliverySections parses the option groups about how the messages are
+// delivered, like spool.dir, out of params.
+func parseArgDeliverySections(c *Config, params map[string]interface{}) error {
+	if v, ok := params["spool"].(map[string]interface{}); ok {
+		spoolConfig, err := spoolParseMap(v)
+		if err != nil {
+			return err
+		}
+		c.Spool = c.Spool.Apply(spoolConfig)
+	}
+	delete(params, "spool")
+
+	if v, ok := params["queue"].(map[string]interface{}); ok {
+		queueConfig, err := queueParseMap(v)
+		if err != nil {
+			return err
+		}
+		c.Queue = c.Queue.Apply(queueConfig)
+	}
+	delete(params, "queue")
+
+	if v, ok := params["stopTest"].(map[string]interface{}); ok {
+		stopTestConfig, err := stopTestParseMap(v)
+		if err != nil {
+			return err
+		}
+		c.StopTest = c.StopTest.Apply(stopTestConfig)
+	}
+	delete(params, "stopTest")
+
+	if v, ok := params["preflight"].(map[string]interface{}); ok {
+		preflightConfig, err := preflightParseMap(v)
+		if err != nil {
+			return err
+		}
+		c.Preflight = c.Preflight.Apply(preflightConfig)
+	}
+	delete(params, "preflight")
+
+	if v, ok := params["createTopic"].(map[string]interface{}); ok {
+		createTopicConfig, err := createTopicParseMap(v)
+		if err != nil {
+			return err
+		}
+		c.CreateTopic = c.CreateTopic.Apply(createTopicConfig)
+	}
+	delete(params, "createTopic")
+
+	return nil
+}
+
+// parseArgFlush parses the options about when samples are flushed out of params.
+func parseArgFlush(c *Config, params map[string]interface{}) error {
+	if v, ok := params["pushInterval"].(string); ok {
+		err := c.PushInterval.UnmarshalText([]byte(v))
+		if err != nil {
+			return err
+		}
+		delete(params, "pushInterval")
+	}
+	if v, ok := params["flushMaxSamples"].(int64); ok {
+		c.FlushMaxSamples = null.IntFrom(v)
+		delete(params, "flushMaxSamples")
+	}
+	if v, ok := params["flushMaxBytes"].(int64); ok {
+		c.FlushMaxBytes = null.IntFrom(v)
+		delete(params, "flushMaxBytes")
+	}
+	return nil
+}
+
+// parseArgMessages parses the options about what messages are produced, and to
+// which topics, out of params.
+func parseArgMessages(c *Config, params map[string]interface{}) {
+	if v, ok := params["topic"].(string); ok {
+		c.Topic = null.StringFrom(v)
+		delete(params, "topic")
+	}
+	if v, ok := params["format"].(string); ok {
+		c.Format = null.StringFrom(v)
+
+		delete(params, "format")
+	}
+	if v, ok := params["routes"].(string); ok {
+		c.Routes = []string{v}
+		delete(params, "routes")
+	}
+	if v, ok := params["routes"].([]interface{}); ok {
+		c.Routes = interfaceSliceToStringSlice(v)
+		delete(params, "routes")
+	}
+	if v, ok := params["key"].(string); ok {
+		c.Key = null.StringFrom(v)
+		delete(params, "key")
+	}
+	if v, ok := params["keyTags"].(string); ok {
+		c.KeyTags = []string{v}
+		delete(params, "keyTags")
+	}
+	if v, ok := params["keyTags"].([]interface{}); ok {
+		c.KeyTags = interfaceSliceToStringSlice(v)
+		delete(params, "keyTags")
+	}
+	if v, ok := params["headers"].(bool); ok {
+		c.Headers = null.BoolFrom(v)
+		delete(params, "headers")
+	}
+	if v, ok := params["testRunID"].(string); ok {
+		c.TestRunID = null.StringFrom(v)
+		delete(params, "testRunID")
+	}
+	if v, ok := params["timestamp"].(string); ok {
+		c.Timestamp = null.StringFrom(v)
+		delete(params, "timestamp")
+	}
+	if v, ok := params["batch"].(string); ok {
+		c.Batch = null.StringFrom(v)
+		delete(params, "batch")
+	}
+	if v, ok := params["batchMaxBytes"].(int64); ok {
+		c.BatchMaxBytes = null.IntFrom(v)
+		delete(params, "batchMaxBytes")
+	}
+	if v, ok := params["maxMessageBytes"].(int64); ok {
+		c.MaxMessageBytes = null.IntFrom(v)
+		delete(params, "maxMessageBytes")
+	}
+}
+
+// parseArgProducer parses the options about how the producer compresses and
+// delivers the messages out of params.
+func parseArgProducer(c *Config, params map[string]interface{}) error {
+	if v, ok := params["compression"].(string); ok {
+		c.Compression = null.StringFrom(v)
+		delete(params, "compression")
+	}
+	if v, ok := params["compressionLevel"].(int64); ok {
+		c.CompressionLevel = null.IntFrom(v)
+		delete(params, "compressionLevel")
+	}
+	switch v := params["acks"].(type) {
+	case string:
+		c.Acks = null.StringFrom(v)
+		delete(params, "acks")
+	case int64:
+		c.Acks = null.StringFrom(strconv.FormatInt(v, 10))
+		delete(params, "acks")
+	}
+	if v, ok := params["idempotent"].(bool); ok {
+		c.Idempotent = null.BoolFrom(v)
+		delete(params, "idempotent")
+	}
+	if v, ok := params["retryMax"].(int64); ok {
+		c.RetryMax = null.IntFrom(v)
+		delete(params, "retryMax")
+	}
+	if v, ok := params["retryBackoff"].(string); ok {
+		if err := c.RetryBackoff.UnmarshalText([]byte(v)); err != nil {
+			return err
+		}
+		delete(params, "retryBackoff")
+	}
+	if v, ok := params["maxOpenRequests"].(int64); ok {
+		c.MaxOpenRequests = null.IntFrom(v)
+		delete(params, "maxOpenRequests")
+	}
+	if v, ok := params["timeout"].(string); ok {
+		if err := c.Timeout.UnmarshalText([]byte(v)); err != nil {
+			return err
+		}
+		delete(params, "timeout")
+	}
+	if v, ok := params["transactional"].(bool); ok {
+		c.Transactional = null.BoolFrom(v)
+		delete(params, "transactional")
+	}
+	if v, ok := params["transactionalIDPrefix"].(string); ok {
+		c.TransactionalIDPrefix = null.StringFrom(v)
+		delete(params, "transactionalIDPrefix")
+	}
+	return nil
+}
+
+// parseArgTLS parses the options about the TLS connection to the brokers out
+// of params.
+func parseArgTLS(c *Config, params map[string]interface{}) {
+	if v, ok := params["ssl"].(bool); ok {
+		c.SSL = null.BoolFrom(v)
+		delete(params, "ssl")
+	}
+	if v, ok := params["insecureSkipTLSVerify"].(bool); ok {
+		c.InsecureSkipTLSVerify = null.BoolFrom(v)
+		delete(params, "insecureSkipTLSVerify")
+	}
+	if v, ok := params["caFile"].(string); ok {
+		c.CAFile = null.StringFrom(v)
+		delete(params, "caFile")
+	}
+	if v, ok := params["certFile"].(string); ok {
+		c.CertFile = null.StringFrom(v)
+		delete(params, "certFile")
+	}
+	if v, ok := params["keyFile"].(string); ok {
+		c.KeyFile = null.StringFrom(v)
+		delete(params, "keyFile")
+	}
+	if v, ok := params["keyPassphrase"].(string); ok {
+		c.KeyPassphrase = null.StringFrom(v)
+		delete(params, "keyPassphrase")
+	}
+	if v, ok := params["keyPassphraseFile"].(string); ok {
+		c.KeyPassphraseFile = null.StringFrom(v)
+		delete(params, "keyPassphraseFile")
+	}
+	if v, ok := params["serverName"].(string); ok {
+		c.ServerName = null.StringFrom(v)
+		delete(params, "serverName")
+	}
+	if v, ok := params["tlsMinVersion"].(string); ok {
+		c.TLSMinVersion = null.StringFrom(v)
+		delete(params, "tlsMinVersion")
+	}
+}
+
 func mapToString(m map[string]interface{}) string {
 	var s string
 	for k, v := range m {
@@ -226,7 +664,7 @@ func GetConsolidatedConfig(jsonRawConf json.RawMessage, env map[string]string, a
 
 	result = result.Apply(envConfig)
 
-	if result.AuthMechanism.String != "none" && (!result.User.Valid || !result.Password.Valid) {
+	if result.usesPasswordAuth() && (!result.hasUser() || !result.hasPassword()) {
 		return result, errors.New("user and password are required when auth mechanism is provided")
 	}
 
@@ -238,5 +676,156 @@ func GetConsolidatedConfig(jsonRawConf json.RawMessage, env map[string]string, a
 		result = result.Apply(urlConf)
 	}
 
+	result, err := result.resolveEnvSecrets(env)
+	if err != nil {
+		return result, err
+	}
+
+	if err := result.validate(); err != nil {
+		return result, err
+	}
+
 	return result, nil
 }
+
+// usesPasswordAuth returns true if the auth mechanism authenticates with the
+// user and password, Kerberos can log in with a keytab instead.
+func (c Config) usesPasswordAuth() bool {
+	switch c.AuthMechanism.String {
+	case "none", "oauthbearer", "aws-msk-iam":
+		return false
+	case "gssapi":
+		return !c.GSSAPI.KeyTab.Valid
+	default:
+		return true
+	}
+}
+
+// hasUser returns true if the SASL user is set, directly or with a file.
+func (c Config) hasUser() bool {
+	return c.User.Valid || c.UserFile.Valid
+}
+
+// hasPassword returns true if the SASL password is set, directly or with a file.
+func (c Config) hasPassword() bool {
+	return c.Password.Valid || c.PasswordFile.Valid
+}
+
+// validate checks the consolidated config for values that can't work together.
+func (c Config) validate() error {
+	if c.PushInterval.Valid && time.Duration(c.PushInterval.Duration) <= 0 {
+		return fmt.Errorf("pushInterval should be positive but was %s", c.PushInterval.Duration)
+	}
+	if c.FlushMaxSamples.Int64 < 0 {
+		return fmt.Errorf("flushMaxSamples can't be negative but was %d", c.FlushMaxSamples.Int64)
+	}
+	if c.FlushMaxBytes.Int64 < 0 {
+		return fmt.Errorf("flushMaxBytes can't be negative but was %d", c.FlushMaxBytes.Int64)
+	}
+	for _, r := range c.Routes {
+		if _, err := parseRoute(r); err != nil {
+			return err
+		}
+	}
+	if err := validateKey(c.Key.String, c.KeyTags); err != nil {
+		return err
+	}
+	if c.Headers.Bool {
+		if err := c.requireVersion(sarama.V0_11_0_0, "headers"); err != nil {
+			return err
+		}
+	}
+	switch c.Timestamp.String {
+	case "", timestampNone:
+	case timestampNewest, timestampOldest:
+		if err := c.requireVersion(sarama.V0_10_0_0, "timestamps"); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid timestamp (%s), it should be one of none, newest or oldest", c.Timestamp.String)
+	}
+	if c.MaxMessageBytes.Valid && c.MaxMessageBytes.Int64 <= 0 {
+		return fmt.Errorf("maxMessageBytes should be positive but was %d", c.MaxMessageBytes.Int64)
+	}
+	if err := c.validateBatch(); err != nil {
+		return err
+	}
+	if err := c.validateCompression(); err != nil {
+		return err
+	}
+	for _, validateOptions := range []func() error{
+		c.validateSecretFiles, c.validateGSSAPI, c.validateMSKIAM, c.validateOAuth, c.validateTLS,
+		c.validateTransactional, c.validateDelivery, c.validateSpool, c.validateQueue, c.validateStopTest,
+		c.validatePreflight, c.validateCreateTopic,
+	} {
+		if err := validateOptions(); err != nil {
+			return err
+		}
+	}
+	if _, err := influxdbPrecision(c.InfluxDBConfig.Precision.String); err != nil {
+		return err
+	}
+	if c.Format.String == "avro" && c.SchemaRegistry.URL.String == "" {
+		return errors.New("schemaRegistry.url is required for the avro format")
+	}
+	return nil
+}
+
+// validateCompression checks that the compression codec is known, supports the
+// configured level and is supported by the configured Kafka version.
+func (c Config) validateCompression() error {
+	codec, err := c.compressionCodec()
+	if err != nil {
+		return err
+	}
+	switch codec {
+	case sarama.CompressionNone, sarama.CompressionSnappy:
+		if c.CompressionLevel.Valid {
+			return fmt.Errorf("compressionLevel isn't supported by the %s compression", codec)
+		}
+	case sarama.CompressionGZIP:
+	case sarama.CompressionLZ4:
+		return c.requireVersion(sarama.V0_10_0_0, "lz4 compression")
+	case sarama.CompressionZSTD:
+		return c.requireVersion(sarama.V2_1_0_0, "zstd compression")
+	}
+	return nil
+}
+
+// compressionCodec returns the configured compression codec, none by default.
+func (c Config) compressionCodec() (sarama.CompressionCodec, error) {
+	codec := sarama.CompressionNone
+	if c.Compression.Valid {
+		if err := codec.UnmarshalText([]byte(c.Compression.String)); err != nil {
+			return codec, fmt.Errorf("invalid compression (%s), it should be one of none, gzip, snappy, lz4 or zstd",
+				c.Compression.String)
+		}
+	}
+	return codec, nil
+}
+
+// requireVersion returns an error if the configured Kafka version is older
+// than the minimum version the feature needs.
+func (c Config) requireVersion(minVersion sarama.KafkaVersion, feature string) error {
+	version, err := sarama.ParseKafkaVersion(c.Version.String)
+	if err != nil {
+		return err
+	}
+	if !version.IsAtLeast(minVersion) {
+		return fmt.Errorf("%s: Kafka version %s or newer is required but the version is %s", feature, minVersion, version)
+	}
+	return nil
+}
+
+// schemaRegistrySubjects returns the configured subject, or the ones the
+// default TopicNameStrategy of the Confluent serializers would use for topics.
+func (c Config) schemaRegistrySubjects(topics []string) []string {
+	if c.SchemaRegistry.Subject.Valid {
+		return []string{c.SchemaRegistry.Subject.String}
+	}
+	subjects := make([]string, len(topics))
+	for i, topic := range topics {
+		subjects[i] = topic + "-value"
+	}
+	return subjects
+}
@@ -130,6 +130,177 @@ func TestConfigParseArg(t *testing.T) {
 	assert.Equal(t, null.StringFrom("johndoe"), c.User)
 	assert.Equal(t, null.BoolFrom(false), c.LogError)
 
+	c, err = ParseArg("brokers=broker1,topic=someTopic,pushInterval=5s,flushMaxSamples=1000,flushMaxBytes=65536")
+	assert.Nil(t, err)
+	assert.Equal(t, types.NullDurationFrom(5*time.Second), c.PushInterval)
+	assert.Equal(t, null.IntFrom(1000), c.FlushMaxSamples)
+	assert.Equal(t, null.IntFrom(65536), c.FlushMaxBytes)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,format=avro,schemaRegistry.url=http://registry:8081,schemaRegistry.user=u,schemaRegistry.password=p")
+	assert.Nil(t, err)
+	assert.Equal(t, null.StringFrom("avro"), c.Format)
+	assert.Equal(t, schemaRegistryConfig{
+		URL:      null.StringFrom("http://registry:8081"),
+		User:     null.StringFrom("u"),
+		Password: null.StringFrom("p"),
+	}, c.SchemaRegistry)
+
+	c, err = ParseArg(`brokers=broker1,topic=someTopic,format=otlp_json,otlp.resourceAttributes.team=perf,otlp.resourceAttributes.deployment\.environment=staging`)
+	assert.Nil(t, err)
+	assert.Equal(t, null.StringFrom("otlp_json"), c.Format)
+	assert.Equal(t, map[string]string{"team": "perf", "deployment.environment": "staging"}, c.OTLPConfig.Attributes)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,format=influxdb,influxdb.precision=ms")
+	assert.Nil(t, err)
+	assert.Equal(t, influxdbConfig{Precision: null.StringFrom("ms")}, c.InfluxDBConfig)
+
+	c, err = ParseArg("brokers=broker1,topic=k6-misc,routes={http_req_*:k6-http,checks:k6-checks,type:trend:k6-trends}")
+	assert.Nil(t, err)
+	assert.Equal(t, null.StringFrom("k6-misc"), c.Topic)
+	assert.Equal(t, []string{"http_req_*:k6-http", "checks:k6-checks", "type:trend:k6-trends"}, c.Routes)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,key=tags,keyTags={scenario,name}")
+	assert.Nil(t, err)
+	assert.Equal(t, null.StringFrom("tags"), c.Key)
+	assert.Equal(t, []string{"scenario", "name"}, c.KeyTags)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,headers=true,testRunID=nightly-42")
+	assert.Nil(t, err)
+	assert.Equal(t, null.BoolFrom(true), c.Headers)
+	assert.Equal(t, null.StringFrom("nightly-42"), c.TestRunID)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,timestamp=oldest")
+	assert.Nil(t, err)
+	assert.Equal(t, null.StringFrom("oldest"), c.Timestamp)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,batch=lines,batchMaxBytes=500000,maxMessageBytes=2000000")
+	assert.Nil(t, err)
+	assert.Equal(t, null.StringFrom("lines"), c.Batch)
+	assert.Equal(t, null.IntFrom(500000), c.BatchMaxBytes)
+	assert.Equal(t, null.IntFrom(2000000), c.MaxMessageBytes)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,compression=zstd,compressionLevel=3")
+	assert.Nil(t, err)
+	assert.Equal(t, null.StringFrom("zstd"), c.Compression)
+	assert.Equal(t, null.IntFrom(3), c.CompressionLevel)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,acks=all,idempotent=true,retryMax=10,retryBackoff=250ms,maxOpenRequests=1,timeout=30s")
+	assert.Nil(t, err)
+	assert.Equal(t, null.StringFrom("all"), c.Acks)
+	assert.Equal(t, null.BoolFrom(true), c.Idempotent)
+	assert.Equal(t, null.IntFrom(10), c.RetryMax)
+	assert.Equal(t, types.NullDurationFrom(250*time.Millisecond), c.RetryBackoff)
+	assert.Equal(t, null.IntFrom(1), c.MaxOpenRequests)
+	assert.Equal(t, types.NullDurationFrom(30*time.Second), c.Timeout)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,transactional=true,transactionalIDPrefix=reports")
+	assert.Nil(t, err)
+	assert.Equal(t, null.BoolFrom(true), c.Transactional)
+	assert.Equal(t, null.StringFrom("reports"), c.TransactionalIDPrefix)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,ssl=true,caFile=ca.pem,certFile=client.pem,keyFile=client.key,keyPassphrase=secret,serverName=kafka.test,tlsMinVersion=1.3")
+	assert.Nil(t, err)
+	assert.Equal(t, null.BoolFrom(true), c.SSL)
+	assert.Equal(t, null.StringFrom("ca.pem"), c.CAFile)
+	assert.Equal(t, null.StringFrom("client.pem"), c.CertFile)
+	assert.Equal(t, null.StringFrom("client.key"), c.KeyFile)
+	assert.Equal(t, null.StringFrom("secret"), c.KeyPassphrase)
+	assert.Equal(t, null.StringFrom("kafka.test"), c.ServerName)
+	assert.Equal(t, null.StringFrom("1.3"), c.TLSMinVersion)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,authMechanism=oauthbearer,oauth.tokenURL=https://idp/token,oauth.clientID=k6,oauth.clientSecret=secret,oauth.scopes={kafka,metrics},oauth.extensions.logicalCluster=lkc-1")
+	assert.Nil(t, err)
+	assert.Equal(t, null.StringFrom("oauthbearer"), c.AuthMechanism)
+	assert.Equal(t, oauthConfig{
+		TokenURL:     null.StringFrom("https://idp/token"),
+		ClientID:     null.StringFrom("k6"),
+		ClientSecret: null.StringFrom("secret"),
+		Scopes:       []string{"kafka", "metrics"},
+		Extensions:   map[string]string{"logicalCluster": "lkc-1"},
+	}, c.OAuth)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,authMechanism=gssapi,user=k6,gssapi.keyTab=/etc/k6.keytab,gssapi.kerberosConfig=/etc/krb5-k6.conf,gssapi.serviceName=kafka-prod,gssapi.realm=EXAMPLE.COM,gssapi.disablePAFXFAST=true")
+	assert.Nil(t, err)
+	assert.Equal(t, null.StringFrom("gssapi"), c.AuthMechanism)
+	assert.Equal(t, gssapiConfig{
+		KeyTab:          null.StringFrom("/etc/k6.keytab"),
+		KerberosConfig:  null.StringFrom("/etc/krb5-k6.conf"),
+		ServiceName:     null.StringFrom("kafka-prod"),
+		Realm:           null.StringFrom("EXAMPLE.COM"),
+		DisablePAFXFAST: null.BoolFrom(true),
+	}, c.GSSAPI)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,authMechanism=aws-msk-iam,aws.region=eu-west-1,aws.profile=perf")
+	assert.Nil(t, err)
+	assert.Equal(t, null.StringFrom("aws-msk-iam"), c.AuthMechanism)
+	assert.Equal(t, awsConfig{Region: null.StringFrom("eu-west-1"), Profile: null.StringFrom("perf")}, c.AWS)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,authMechanism=scram-sha-512,userFile=/run/secrets/user,passwordFile=/run/secrets/password,keyPassphraseFile=/run/secrets/key,oauth.clientSecretFile=/run/secrets/oauth,schemaRegistry.passwordFile=/run/secrets/registry")
+	assert.Nil(t, err)
+	assert.Equal(t, null.StringFrom("/run/secrets/user"), c.UserFile)
+	assert.Equal(t, null.StringFrom("/run/secrets/password"), c.PasswordFile)
+	assert.Equal(t, null.StringFrom("/run/secrets/key"), c.KeyPassphraseFile)
+	assert.Equal(t, null.StringFrom("/run/secrets/oauth"), c.OAuth.ClientSecretFile)
+	assert.Equal(t, null.StringFrom("/run/secrets/registry"), c.SchemaRegistry.PasswordFile)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,spool.dir=/var/spool/k6,spool.maxBytes=1048576,spool.eviction=drop-newest,spool.drain=false,spool.drainTimeout=1m")
+	assert.Nil(t, err)
+	assert.Equal(t, spoolConfig{
+		Dir:          null.StringFrom("/var/spool/k6"),
+		MaxBytes:     null.IntFrom(1048576),
+		Eviction:     null.StringFrom("drop-newest"),
+		Drain:        null.BoolFrom(false),
+		DrainTimeout: types.NullDurationFrom(time.Minute),
+	}, c.Spool)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,queue.maxMessages=1000,queue.maxBytes=1048576,queue.overflow=drop-by-metric-priority,queue.priorities={checks,http_req_failed}")
+	assert.Nil(t, err)
+	assert.Equal(t, queueConfig{
+		MaxMessages: null.IntFrom(1000),
+		MaxBytes:    null.IntFrom(1048576),
+		Overflow:    null.StringFrom("drop-by-metric-priority"),
+		Priorities:  []string{"checks", "http_req_failed"},
+	}, c.Queue)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,stopTest.consecutiveFailures=5,stopTest.failureRate=12.5,stopTest.window=30s,stopTest.minMessages=100")
+	assert.Nil(t, err)
+	assert.Equal(t, stopTestConfig{
+		ConsecutiveFailures: null.IntFrom(5),
+		FailureRate:         null.FloatFrom(12.5),
+		Window:              types.NullDurationFrom(30 * time.Second),
+		MinMessages:         null.IntFrom(100),
+	}, c.StopTest)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,preflight.enabled=true,preflight.timeout=5s,preflight.checkWrite=true,preflight.principal=User:k6")
+	assert.Nil(t, err)
+	assert.Equal(t, preflightConfig{
+		Enabled:    null.BoolFrom(true),
+		Timeout:    types.NullDurationFrom(5 * time.Second),
+		CheckWrite: null.BoolFrom(true),
+		Principal:  null.StringFrom("User:k6"),
+	}, c.Preflight)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,createTopic.enabled=true,createTopic.partitions=6,createTopic.replicationFactor=3,createTopic.configs.retention.ms=86400000,createTopic.configs.cleanup.policy={compact,delete},createTopic.configs.compression.type=zstd")
+	assert.Nil(t, err)
+	assert.Equal(t, createTopicConfig{
+		Enabled:           null.BoolFrom(true),
+		Partitions:        null.IntFrom(6),
+		ReplicationFactor: null.IntFrom(3),
+		Configs: map[string]string{
+			"retention.ms":     "86400000",
+			"cleanup.policy":   "compact,delete",
+			"compression.type": "zstd",
+		},
+	}, c.CreateTopic)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,deliveryReport=results/kafka.json")
+	assert.Nil(t, err)
+	assert.Equal(t, null.StringFrom("results/kafka.json"), c.DeliveryReport)
+
+	c, err = ParseArg("brokers=broker1,topic=someTopic,acks=0")
+	assert.Nil(t, err)
+	assert.Equal(t, null.StringFrom("0"), c.Acks)
+
 	_, err = ParseArg("badOption=212")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), `Unknown or unparsed options 'badOption=212'`)
@@ -287,6 +458,502 @@ func TestConsolidatedConfig(t *testing.T) {
 				Brokers:               []string{"something"},
 			},
 		},
+		"flush-limits-through-env": {
+			env: map[string]string{
+				"K6_KAFKA_PUSH_INTERVAL":     "200ms",
+				"K6_KAFKA_FLUSH_MAX_SAMPLES": "500",
+				"K6_KAFKA_FLUSH_MAX_BYTES":   "1048576",
+			},
+			config: Config{
+				Format:                null.StringFrom("json"),
+				PushInterval:          types.NullDurationFrom(200 * time.Millisecond),
+				FlushMaxSamples:       null.IntFrom(500),
+				FlushMaxBytes:         null.IntFrom(1048576),
+				InfluxDBConfig:        newInfluxdbConfig(),
+				AuthMechanism:         null.StringFrom("none"),
+				Version:               null.StringFrom(sarama.DefaultVersion.String()),
+				SSL:                   null.BoolFrom(false),
+				InsecureSkipTLSVerify: null.BoolFrom(false),
+				LogError:              null.BoolFrom(true),
+			},
+		},
+		"invalid-push-interval": {
+			arg: "pushInterval=0s",
+			err: "pushInterval should be positive",
+		},
+		"avro-without-registry": {
+			arg: "format=avro",
+			err: "schemaRegistry.url is required for the avro format",
+		},
+		"avro-registry-through-env": {
+			env: map[string]string{
+				"K6_KAFKA_FORMAT":                  "avro",
+				"K6_KAFKA_SCHEMA_REGISTRY_URL":     "http://registry:8081",
+				"K6_KAFKA_SCHEMA_REGISTRY_SUBJECT": "k6-samples",
+			},
+			config: Config{
+				Format:                null.StringFrom("avro"),
+				PushInterval:          types.NullDurationFrom(1 * time.Second),
+				InfluxDBConfig:        newInfluxdbConfig(),
+				AuthMechanism:         null.StringFrom("none"),
+				Version:               null.StringFrom(sarama.DefaultVersion.String()),
+				SSL:                   null.BoolFrom(false),
+				InsecureSkipTLSVerify: null.BoolFrom(false),
+				LogError:              null.BoolFrom(true),
+				SchemaRegistry: schemaRegistryConfig{
+					URL:     null.StringFrom("http://registry:8081"),
+					Subject: null.StringFrom("k6-samples"),
+				},
+			},
+		},
+		"routes-through-env": {
+			env: map[string]string{
+				"K6_KAFKA_TOPIC":  "k6-misc",
+				"K6_KAFKA_ROUTES": "http_req_*:k6-http,type:counter:k6-counters",
+			},
+			config: Config{
+				Format:                null.StringFrom("json"),
+				Topic:                 null.StringFrom("k6-misc"),
+				Routes:                []string{"http_req_*:k6-http", "type:counter:k6-counters"},
+				PushInterval:          types.NullDurationFrom(1 * time.Second),
+				InfluxDBConfig:        newInfluxdbConfig(),
+				AuthMechanism:         null.StringFrom("none"),
+				Version:               null.StringFrom(sarama.DefaultVersion.String()),
+				SSL:                   null.BoolFrom(false),
+				InsecureSkipTLSVerify: null.BoolFrom(false),
+				LogError:              null.BoolFrom(true),
+			},
+		},
+		"create-topic-through-env": {
+			env: map[string]string{
+				"K6_KAFKA_CREATE_TOPIC_ENABLED":    "true",
+				"K6_KAFKA_CREATE_TOPIC_PARTITIONS": "12",
+				"K6_KAFKA_CREATE_TOPIC_CONFIGS":    "retention.ms:3600000,compression.type:lz4",
+			},
+			config: Config{
+				Format:                null.StringFrom("json"),
+				PushInterval:          types.NullDurationFrom(1 * time.Second),
+				InfluxDBConfig:        newInfluxdbConfig(),
+				AuthMechanism:         null.StringFrom("none"),
+				Version:               null.StringFrom(sarama.DefaultVersion.String()),
+				SSL:                   null.BoolFrom(false),
+				InsecureSkipTLSVerify: null.BoolFrom(false),
+				LogError:              null.BoolFrom(true),
+				CreateTopic: createTopicConfig{
+					Enabled:    null.BoolFrom(true),
+					Partitions: null.IntFrom(12),
+					Configs:    map[string]string{"retention.ms": "3600000", "compression.type": "lz4"},
+				},
+			},
+		},
+		"invalid-route": {
+			arg: "routes={http_req_*}",
+			err: "invalid route (http_req_*)",
+		},
+		"invalid-route-type": {
+			arg: "routes={type:histogram:k6-histograms}",
+			err: "invalid route (type:histogram:k6-histograms)",
+		},
+		"invalid-key": {
+			arg: "key=random",
+			err: "invalid key (random)",
+		},
+		"key-tags-without-tags": {
+			env: map[string]string{
+				"K6_KAFKA_KEY": "tags",
+			},
+			err: "keyTags is required when key is tags",
+		},
+		"headers-with-old-version": {
+			arg: "headers=true,version=0.10.2.0",
+			err: "headers: Kafka version 0.11.0.0 or newer is required but the version is 0.10.2.0",
+		},
+		"invalid-timestamp": {
+			arg: "timestamp=sample",
+			err: "invalid timestamp (sample), it should be one of none, newest or oldest",
+		},
+		"timestamp-with-old-version": {
+			env: map[string]string{
+				"K6_KAFKA_TIMESTAMP": "newest",
+				"K6_KAFKA_VERSION":   "0.9.0.1",
+			},
+			err: "timestamps: Kafka version 0.10.0.0 or newer is required",
+		},
+		"invalid-batch": {
+			arg: "batch=ndjson",
+			err: "invalid batch (ndjson), it should be one of none, lines or array",
+		},
+		"batch-array-with-influxdb": {
+			arg: "format=influxdb,batch=array",
+			err: "batch=array is only supported with the json format",
+		},
+		"batch-lines-with-avro": {
+			arg: "format=avro,batch=lines,schemaRegistry.url=http://registry:8081",
+			err: "batch=lines is only supported with the json and influxdb formats",
+		},
+		"batch-larger-than-max-message": {
+			arg: "batch=lines,batchMaxBytes=2000,maxMessageBytes=1000",
+			err: "batchMaxBytes (2000) can't be larger than maxMessageBytes (1000)",
+		},
+		"compression-through-env": {
+			env: map[string]string{
+				"K6_KAFKA_COMPRESSION":       "gzip",
+				"K6_KAFKA_COMPRESSION_LEVEL": "9",
+			},
+			config: Config{
+				Format:                null.StringFrom("json"),
+				PushInterval:          types.NullDurationFrom(1 * time.Second),
+				InfluxDBConfig:        newInfluxdbConfig(),
+				AuthMechanism:         null.StringFrom("none"),
+				Version:               null.StringFrom(sarama.DefaultVersion.String()),
+				SSL:                   null.BoolFrom(false),
+				InsecureSkipTLSVerify: null.BoolFrom(false),
+				LogError:              null.BoolFrom(true),
+				Compression:           null.StringFrom("gzip"),
+				CompressionLevel:      null.IntFrom(9),
+			},
+		},
+		"invalid-compression": {
+			arg: "compression=brotli",
+			err: "invalid compression (brotli), it should be one of none, gzip, snappy, lz4 or zstd",
+		},
+		"compression-level-with-snappy": {
+			arg: "compression=snappy,compressionLevel=1",
+			err: "compressionLevel isn't supported by the snappy compression",
+		},
+		"zstd-with-old-version": {
+			arg: "compression=zstd,version=2.0.0",
+			err: "zstd compression: Kafka version 2.1.0 or newer is required but the version is 2.0.0",
+		},
+		"lz4-with-old-version": {
+			arg: "compression=lz4,version=0.9.0.0",
+			err: "lz4 compression: Kafka version 0.10.0.0 or newer is required",
+		},
+		"delivery-through-env": {
+			env: map[string]string{
+				"K6_KAFKA_ACKS":          "all",
+				"K6_KAFKA_IDEMPOTENT":    "true",
+				"K6_KAFKA_RETRY_MAX":     "5",
+				"K6_KAFKA_RETRY_BACKOFF": "1s",
+				"K6_KAFKA_TIMEOUT":       "20s",
+			},
+			config: Config{
+				Format:                null.StringFrom("json"),
+				PushInterval:          types.NullDurationFrom(1 * time.Second),
+				InfluxDBConfig:        newInfluxdbConfig(),
+				AuthMechanism:         null.StringFrom("none"),
+				Version:               null.StringFrom(sarama.DefaultVersion.String()),
+				SSL:                   null.BoolFrom(false),
+				InsecureSkipTLSVerify: null.BoolFrom(false),
+				LogError:              null.BoolFrom(true),
+				Acks:                  null.StringFrom("all"),
+				Idempotent:            null.BoolFrom(true),
+				RetryMax:              null.IntFrom(5),
+				RetryBackoff:          types.NullDurationFrom(1 * time.Second),
+				Timeout:               types.NullDurationFrom(20 * time.Second),
+			},
+		},
+		"invalid-acks": {
+			arg: "acks=2",
+			err: "invalid acks (2), it should be one of 0, 1 or all",
+		},
+		"idempotent-without-acks-all": {
+			arg: "idempotent=true,acks=1",
+			err: "idempotent requires acks=all but acks is 1",
+		},
+		"idempotent-with-many-open-requests": {
+			arg: "idempotent=true,maxOpenRequests=5",
+			err: "idempotent requires maxOpenRequests=1 but maxOpenRequests is 5",
+		},
+		"idempotent-without-retries": {
+			arg: "idempotent=true,retryMax=0",
+			err: "idempotent requires retryMax to be at least 1",
+		},
+		"idempotent-with-old-version": {
+			arg: "idempotent=true,version=0.10.2.0",
+			err: "idempotent: Kafka version 0.11.0.0 or newer is required",
+		},
+		"transactional-without-idempotent": {
+			arg: "transactional=true,idempotent=false",
+			err: "transactional requires idempotent",
+		},
+		"transactional-without-acks-all": {
+			arg: "transactional=true,acks=1",
+			err: "idempotent requires acks=all but acks is 1",
+		},
+		"transactional-with-old-version": {
+			arg: "transactional=true,version=0.10.2.0",
+			err: "idempotent: Kafka version 0.11.0.0 or newer is required",
+		},
+		"tls-options-without-ssl": {
+			arg: "caFile=ca.pem",
+			err: "caFile, certFile, keyFile, serverName and tlsMinVersion require ssl=true",
+		},
+		"cert-file-without-key-file": {
+			env: map[string]string{
+				"K6_KAFKA_SSL":       "true",
+				"K6_KAFKA_CERT_FILE": "client.pem",
+			},
+			err: "certFile and keyFile should be set together",
+		},
+		"invalid-tls-min-version": {
+			arg: "ssl=true,tlsMinVersion=1.4",
+			err: "invalid tlsMinVersion (1.4), it should be one of 1.0, 1.1, 1.2 or 1.3",
+		},
+		"oauthbearer-through-env": {
+			env: map[string]string{
+				"K6_KAFKA_AUTH_MECHANISM":   "oauthbearer",
+				"K6_KAFKA_OAUTH_TOKEN_FILE": "/run/secrets/kafka-token",
+				"K6_KAFKA_VERSION":          "2.8.0",
+			},
+			config: Config{
+				Format:                null.StringFrom("json"),
+				PushInterval:          types.NullDurationFrom(1 * time.Second),
+				InfluxDBConfig:        newInfluxdbConfig(),
+				AuthMechanism:         null.StringFrom("oauthbearer"),
+				Version:               null.StringFrom("2.8.0"),
+				SSL:                   null.BoolFrom(false),
+				InsecureSkipTLSVerify: null.BoolFrom(false),
+				LogError:              null.BoolFrom(true),
+				OAuth: oauthConfig{
+					TokenFile: null.StringFrom("/run/secrets/kafka-token"),
+				},
+			},
+		},
+		"gssapi-keytab-through-env": {
+			env: map[string]string{
+				"K6_KAFKA_AUTH_MECHANISM": "gssapi",
+				"K6_KAFKA_SASL_USER":      "k6",
+				"K6_KAFKA_GSSAPI_KEYTAB":  "/etc/k6.keytab",
+				"K6_KAFKA_GSSAPI_REALM":   "EXAMPLE.COM",
+			},
+			config: Config{
+				Format:                null.StringFrom("json"),
+				PushInterval:          types.NullDurationFrom(1 * time.Second),
+				InfluxDBConfig:        newInfluxdbConfig(),
+				AuthMechanism:         null.StringFrom("gssapi"),
+				User:                  null.StringFrom("k6"),
+				Version:               null.StringFrom(sarama.DefaultVersion.String()),
+				SSL:                   null.BoolFrom(false),
+				InsecureSkipTLSVerify: null.BoolFrom(false),
+				LogError:              null.BoolFrom(true),
+				GSSAPI: gssapiConfig{
+					KeyTab: null.StringFrom("/etc/k6.keytab"),
+					Realm:  null.StringFrom("EXAMPLE.COM"),
+				},
+			},
+		},
+		"gssapi-without-keytab-or-password": {
+			env: map[string]string{
+				"K6_KAFKA_AUTH_MECHANISM": "gssapi",
+				"K6_KAFKA_SASL_USER":      "k6",
+			},
+			err: "user and password are required when auth mechanism is provided",
+		},
+		"gssapi-without-realm": {
+			arg: "authMechanism=gssapi,user=k6,gssapi.keyTab=/etc/k6.keytab",
+			err: "gssapi.realm is required for the gssapi auth mechanism",
+		},
+		"gssapi-without-user": {
+			arg: "authMechanism=gssapi,gssapi.keyTab=/etc/k6.keytab,gssapi.realm=EXAMPLE.COM",
+			err: "user is required for the gssapi auth mechanism",
+		},
+		"aws-msk-iam-without-credentials-in-config": {
+			env: map[string]string{
+				"K6_KAFKA_AUTH_MECHANISM": "aws-msk-iam",
+				"K6_KAFKA_AWS_REGION":     "eu-west-1",
+				"K6_KAFKA_SSL":            "true",
+				"K6_KAFKA_VERSION":        "2.8.0",
+			},
+			config: Config{
+				Format:                null.StringFrom("json"),
+				PushInterval:          types.NullDurationFrom(1 * time.Second),
+				InfluxDBConfig:        newInfluxdbConfig(),
+				AuthMechanism:         null.StringFrom("aws-msk-iam"),
+				Version:               null.StringFrom("2.8.0"),
+				SSL:                   null.BoolFrom(true),
+				InsecureSkipTLSVerify: null.BoolFrom(false),
+				LogError:              null.BoolFrom(true),
+				AWS:                   awsConfig{Region: null.StringFrom("eu-west-1")},
+			},
+		},
+		"aws-msk-iam-without-ssl": {
+			arg: "authMechanism=aws-msk-iam,version=2.8.0",
+			err: "the aws-msk-iam auth mechanism requires ssl=true",
+		},
+		"aws-msk-iam-with-old-version": {
+			arg: "authMechanism=aws-msk-iam,ssl=true,version=1.1.0",
+			err: "aws-msk-iam: Kafka version 2.0.0 or newer is required",
+		},
+		"oauthbearer-without-token-source": {
+			arg: "authMechanism=oauthbearer,version=2.8.0",
+			err: "exactly one of oauth.token, oauth.tokenFile or oauth.tokenURL is required",
+		},
+		"oauthbearer-with-many-token-sources": {
+			arg: "authMechanism=oauthbearer,version=2.8.0,oauth.token=abc,oauth.tokenFile=token",
+			err: "exactly one of oauth.token, oauth.tokenFile or oauth.tokenURL is required",
+		},
+		"oauthbearer-without-client-credentials": {
+			arg: "authMechanism=oauthbearer,version=2.8.0,oauth.tokenURL=https://idp/token",
+			err: "oauth.clientID and oauth.clientSecret are required with oauth.tokenURL",
+		},
+		"oauthbearer-extensions-with-old-version": {
+			arg: "authMechanism=oauthbearer,version=2.0.0,oauth.token=abc,oauth.extensions.a=b",
+			err: "oauth.extensions: Kafka version 2.1.0 or newer is required",
+		},
+		"oauthbearer-with-old-version": {
+			arg: "authMechanism=oauthbearer,version=1.1.0,oauth.token=abc",
+			err: "oauthbearer: Kafka version 2.0.0 or newer is required",
+		},
+		"password-file": {
+			env: map[string]string{
+				"K6_KAFKA_AUTH_MECHANISM":     "scram-sha-512",
+				"K6_KAFKA_SASL_USER":          "testuser",
+				"K6_KAFKA_SASL_PASSWORD_FILE": "/run/secrets/kafka",
+			},
+			config: Config{
+				Format:                null.StringFrom("json"),
+				PushInterval:          types.NullDurationFrom(1 * time.Second),
+				InfluxDBConfig:        newInfluxdbConfig(),
+				AuthMechanism:         null.StringFrom("scram-sha-512"),
+				Version:               null.StringFrom(sarama.DefaultVersion.String()),
+				SSL:                   null.BoolFrom(false),
+				InsecureSkipTLSVerify: null.BoolFrom(false),
+				LogError:              null.BoolFrom(true),
+				User:                  null.StringFrom("testuser"),
+				PasswordFile:          null.StringFrom("/run/secrets/kafka"),
+			},
+		},
+		"password-from-env-variable": {
+			env: map[string]string{
+				"KAFKA_PASSWORD": "password123",
+			},
+			arg: "authMechanism=plain,user=testuser,password=env:KAFKA_PASSWORD",
+			config: Config{
+				Format:                null.StringFrom("json"),
+				PushInterval:          types.NullDurationFrom(1 * time.Second),
+				InfluxDBConfig:        newInfluxdbConfig(),
+				AuthMechanism:         null.StringFrom("plain"),
+				Version:               null.StringFrom(sarama.DefaultVersion.String()),
+				SSL:                   null.BoolFrom(false),
+				InsecureSkipTLSVerify: null.BoolFrom(false),
+				LogError:              null.BoolFrom(true),
+				User:                  null.StringFrom("testuser"),
+				Password:              null.StringFrom("password123"),
+			},
+		},
+		"password-from-missing-env-variable": {
+			arg: "authMechanism=plain,user=testuser,password=env:KAFKA_PASSWORD",
+			err: "the KAFKA_PASSWORD environment variable of a secret option isn't set",
+		},
+		"password-and-password-file": {
+			arg: "authMechanism=plain,user=testuser,password=abc,passwordFile=/run/secrets/kafka",
+			err: "password and passwordFile can't be set together",
+		},
+		"password-file-with-plain": {
+			arg: "authMechanism=plain,user=testuser,passwordFile=/run/secrets/kafka",
+			err: "userFile and passwordFile require the scram-sha-256 or scram-sha-512 authMechanism, not plain",
+		},
+		"user-file-with-gssapi": {
+			arg: "authMechanism=gssapi,userFile=/run/secrets/user,gssapi.keyTab=/etc/k6.keytab,gssapi.realm=EXAMPLE.COM",
+			err: "userFile and passwordFile require the scram-sha-256 or scram-sha-512 authMechanism, not gssapi",
+		},
+		"registry-password-and-password-file": {
+			arg: "schemaRegistry.password=abc,schemaRegistry.passwordFile=/run/secrets/registry",
+			err: "schemaRegistry.password and schemaRegistry.passwordFile can't be set together",
+		},
+		"key-passphrase-file-without-key-file": {
+			arg: "ssl=true,keyPassphraseFile=/run/secrets/key",
+			err: "keyPassphrase and keyPassphraseFile require keyFile",
+		},
+		"invalid-spool-eviction": {
+			env: map[string]string{
+				"K6_KAFKA_SPOOL_DIR":      "/var/spool/k6",
+				"K6_KAFKA_SPOOL_EVICTION": "drop-random",
+			},
+			err: "invalid spool.eviction (drop-random), it should be one of drop-oldest or drop-newest",
+		},
+		"non-positive-spool-max-bytes": {
+			arg: "spool.dir=/var/spool/k6,spool.maxBytes=0",
+			err: "spool.maxBytes should be positive but was 0",
+		},
+		"invalid-queue-overflow": {
+			env: map[string]string{
+				"K6_KAFKA_QUEUE_OVERFLOW": "drop-all",
+			},
+			err: "invalid queue.overflow (drop-all), it should be one of block, drop-oldest, drop-newest or drop-by-metric-priority",
+		},
+		"queue-priorities-without-overflow": {
+			arg: "queue.priorities=checks",
+			err: "queue.priorities requires queue.overflow=drop-by-metric-priority",
+		},
+		"queue-with-transactional": {
+			arg: "transactional=true,queue.overflow=drop-oldest",
+			err: "the queue options can't be used with transactional",
+		},
+		"non-positive-stop-test-consecutive-failures": {
+			arg: "stopTest.consecutiveFailures=0",
+			err: "stopTest.consecutiveFailures should be positive but was 0",
+		},
+		"invalid-stop-test-failure-rate": {
+			env: map[string]string{
+				"K6_KAFKA_STOP_TEST_FAILURE_RATE": "120",
+			},
+			err: "stopTest.failureRate should be a percentage between 0 and 100 but was 120",
+		},
+		"stop-test-window-without-failure-rate": {
+			arg: "stopTest.window=30s",
+			err: "stopTest.window and stopTest.minMessages require stopTest.failureRate",
+		},
+		"short-stop-test-window": {
+			arg: "stopTest.failureRate=10,stopTest.window=100ms",
+			err: "stopTest.window should be at least 1s but was 100ms",
+		},
+		"preflight-timeout-without-enabled": {
+			env: map[string]string{
+				"K6_KAFKA_PREFLIGHT_TIMEOUT": "5s",
+			},
+			err: "preflight.timeout, preflight.checkWrite and preflight.principal require preflight.enabled",
+		},
+		"non-positive-preflight-timeout": {
+			arg: "preflight.enabled=true,preflight.timeout=0s",
+			err: "preflight.timeout should be positive but was 0s",
+		},
+		"preflight-check-write-without-principal": {
+			arg: "preflight.enabled=true,preflight.checkWrite=true",
+			err: "preflight.checkWrite requires preflight.principal with the none authMechanism",
+		},
+		"create-topic-partitions-without-enabled": {
+			arg: "createTopic.partitions=3",
+			err: "createTopic.partitions, createTopic.replicationFactor and createTopic.configs require createTopic.enabled",
+		},
+		"non-positive-create-topic-replication-factor": {
+			env: map[string]string{
+				"K6_KAFKA_CREATE_TOPIC_ENABLED":            "true",
+				"K6_KAFKA_CREATE_TOPIC_REPLICATION_FACTOR": "0",
+			},
+			err: "createTopic.replicationFactor should be between 1 and 32767 but was 0",
+		},
+		"create-topic-with-old-version": {
+			arg: "version=0.10.0.0,createTopic.enabled=true",
+			err: "createTopic: Kafka version 0.10.1.0 or newer is required but the version is 0.10.0.0",
+		},
+		"non-positive-timeout": {
+			arg: "timeout=0s",
+			err: "timeout should be positive but was 0s",
+		},
+		"invalid-influxdb-precision": {
+			env: map[string]string{
+				"K6_INFLUXDB_PRECISION": "minutes",
+			},
+			err: "invalid InfluxDB precision (minutes)",
+		},
+		"negative-flush-max-samples": {
+			env: map[string]string{
+				"K6_KAFKA_FLUSH_MAX_SAMPLES": "-1",
+			},
+			err: "flushMaxSamples can't be negative",
+		},
 	}
 
 	for name, testCase := range testCases {
@@ -0,0 +1,178 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"gopkg.in/guregu/null.v3"
+)
+
+const (
+	defaultCreateTopicPartitions        = 1
+	defaultCreateTopicReplicationFactor = 1
+)
+
+type createTopicConfig struct {
+	Enabled           null.Bool `json:"enabled" envconfig:"K6_KAFKA_CREATE_TOPIC_ENABLED"`
+	Partitions        null.Int  `json:"partitions" envconfig:"K6_KAFKA_CREATE_TOPIC_PARTITIONS"`
+	ReplicationFactor null.Int  `json:"replicationFactor" envconfig:"K6_KAFKA_CREATE_TOPIC_REPLICATION_FACTOR"`
+	// Configs are the topic configs, like retention.ms or cleanup.policy.
+	Configs map[string]string `json:"configs,omitempty" envconfig:"K6_KAFKA_CREATE_TOPIC_CONFIGS"`
+}
+
+func (c createTopicConfig) Apply(cfg createTopicConfig) createTopicConfig {
+	if cfg.Enabled.Valid {
+		c.Enabled = cfg.Enabled
+	}
+	if cfg.Partitions.Valid {
+		c.Partitions = cfg.Partitions
+	}
+	if cfg.ReplicationFactor.Valid {
+		c.ReplicationFactor = cfg.ReplicationFactor
+	}
+	if len(cfg.Configs) > 0 {
+		c.Configs = cfg.Configs
+	}
+	return c
+}
+
+// createTopicParseMap parses a map[string]interface{} into a createTopicConfig
+func createTopicParseMap(m map[string]interface{}) (createTopicConfig, error) {
+	c := createTopicConfig{}
+	if v, ok := m["enabled"].(bool); ok {
+		c.Enabled = null.BoolFrom(v)
+		delete(m, "enabled")
+	}
+	if v, ok := m["partitions"].(int64); ok {
+		c.Partitions = null.IntFrom(v)
+		delete(m, "partitions")
+	}
+	if v, ok := m["replicationFactor"].(int64); ok {
+		c.ReplicationFactor = null.IntFrom(v)
+		delete(m, "replicationFactor")
+	}
+	if v, ok := m["configs"].(map[string]interface{}); ok {
+		c.Configs = make(map[string]string)
+		flattenTopicConfigs(c.Configs, "", v)
+		delete(m, "configs")
+	}
+	if len(m) > 0 {
+		return c, errors.New("Unknown or unparsed options '" + mapToString(m) + "'")
+	}
+	return c, nil
+}
+
+// flattenTopicConfigs joins back the dotted names of the topic configs, like
+// retention.ms, that the argument parser splits into nested maps. Lists, like
+// cleanup.policy={compact,delete}, become comma-separated values.
+func flattenTopicConfigs(configs map[string]string, prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		name := prefix + k
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flattenTopicConfigs(configs, name+".", v)
+		case []interface{}:
+			configs[name] = strings.Join(interfaceSliceToStringSlice(v), ",")
+		default:
+			configs[name] = fmt.Sprintf("%v", v)
+		}
+	}
+}
+
+func (c Config) validateCreateTopic() error {
+	if !c.CreateTopic.Enabled.Bool {
+		if c.CreateTopic.Partitions.Valid || c.CreateTopic.ReplicationFactor.Valid || len(c.CreateTopic.Configs) > 0 {
+			return errors.New("createTopic.partitions, createTopic.replicationFactor and createTopic.configs " +
+				"require createTopic.enabled")
+		}
+		return nil
+	}
+	if err := c.requireVersion(sarama.V0_10_1_0, "createTopic"); err != nil {
+		return err
+	}
+	if p := c.CreateTopic.Partitions; p.Valid && (p.Int64 <= 0 || p.Int64 > math.MaxInt32) {
+		return fmt.Errorf("createTopic.partitions should be between 1 and %d but was %d", math.MaxInt32, p.Int64)
+	}
+	if r := c.CreateTopic.ReplicationFactor; r.Valid && (r.Int64 <= 0 || r.Int64 > math.MaxInt16) {
+		return fmt.Errorf("createTopic.replicationFactor should be between 1 and %d but was %d",
+			math.MaxInt16, r.Int64)
+	}
+	return nil
+}
+
+// topicDetail returns the partitions, replication factor and configs of the
+// topics to create.
+func (c createTopicConfig) topicDetail() *sarama.TopicDetail {
+	detail := &sarama.TopicDetail{
+		NumPartitions:     defaultCreateTopicPartitions,
+		ReplicationFactor: defaultCreateTopicReplicationFactor,
+		ConfigEntries:     make(map[string]*string, len(c.Configs)),
+	}
+	if c.Partitions.Valid {
+		detail.NumPartitions = int32(c.Partitions.Int64)
+	}
+	if c.ReplicationFactor.Valid {
+		detail.ReplicationFactor = int16(c.ReplicationFactor.Int64)
+	}
+	for name, value := range c.Configs {
+		value := value
+		detail.ConfigEntries[name] = &value
+	}
+	return detail
+}
+
+// createTopics creates the topic, and every routed topic, that doesn't exist
+// yet, when createTopic.enabled is set. The existing topics are left as they
+// are, even if their partitions or configs differ.
+func (o *Output) createTopics() error {
+	if !o.Config.CreateTopic.Enabled.Bool || o.newClusterAdmin == nil {
+		return nil
+	}
+	admin, err := o.newClusterAdmin()
+	if err != nil {
+		return fmt.Errorf("couldn't reach the Kafka brokers %s: %w", strings.Join(o.Config.Brokers, ","), err)
+	}
+	defer func() {
+		_ = admin.Close()
+	}()
+
+	detail := o.Config.CreateTopic.topicDetail()
+	for _, topic := range o.router.topics() {
+		logger := o.logger.WithField("topic", topic)
+		createErr := admin.CreateTopic(topic, detail, false)
+		switch {
+		case createErr == nil:
+			logger.WithField("partitions", detail.NumPartitions).
+				WithField("replicationFactor", detail.ReplicationFactor).
+				Info("Kafka: Created the topic")
+		case errors.Is(createErr, sarama.ErrTopicAlreadyExists):
+			logger.Debug("Kafka: The topic already exists")
+		default:
+			return fmt.Errorf("couldn't create the %q Kafka topic: %w", topic, createErr)
+		}
+	}
+	return nil
+}
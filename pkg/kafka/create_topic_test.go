@@ -0,0 +1,100 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/guregu/null.v3"
+)
+
+func newCreateTopicTestBroker(t *testing.T, topicErrors map[string]sarama.KError) *sarama.MockBroker {
+	t.Helper()
+	broker := sarama.NewMockBroker(t, 1)
+	response := &sarama.CreateTopicsResponse{Version: 2, TopicErrors: make(map[string]*sarama.TopicError)}
+	for topic, err := range topicErrors {
+		response.TopicErrors[topic] = &sarama.TopicError{Err: err}
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetController(broker.BrokerID()).
+			SetBroker(broker.Addr(), broker.BrokerID()),
+		"CreateTopicsRequest": sarama.NewMockWrapper(response),
+	})
+	return broker
+}
+
+func TestCreateTopics(t *testing.T) {
+	t.Parallel()
+	broker := newCreateTopicTestBroker(t, map[string]sarama.KError{
+		"my_topic":      sarama.ErrTopicAlreadyExists,
+		"my_http_topic": sarama.ErrNoError,
+	})
+	defer broker.Close()
+
+	config := NewConfig()
+	config.Brokers = []string{broker.Addr()}
+	config.Topic = null.StringFrom("my_topic")
+	config.Routes = []string{"http_*:my_http_topic"}
+	config.CreateTopic = createTopicConfig{
+		Enabled:           null.BoolFrom(true),
+		Partitions:        null.IntFrom(6),
+		ReplicationFactor: null.IntFrom(3),
+		Configs:           map[string]string{"retention.ms": "86400000", "cleanup.policy": "compact,delete"},
+	}
+	require.NoError(t, newPreflightTestOutput(t, config).createTopics())
+
+	var created []string
+	for _, call := range broker.History() {
+		request, ok := call.Request.(*sarama.CreateTopicsRequest)
+		if !ok {
+			continue
+		}
+		for topic, detail := range request.TopicDetails {
+			created = append(created, topic)
+			assert.Equal(t, int32(6), detail.NumPartitions)
+			assert.Equal(t, int16(3), detail.ReplicationFactor)
+			require.Len(t, detail.ConfigEntries, 2)
+			assert.Equal(t, "86400000", *detail.ConfigEntries["retention.ms"])
+			assert.Equal(t, "compact,delete", *detail.ConfigEntries["cleanup.policy"])
+		}
+	}
+	assert.Equal(t, []string{"my_topic", "my_http_topic"}, created)
+}
+
+func TestCreateTopicsError(t *testing.T) {
+	t.Parallel()
+	broker := newCreateTopicTestBroker(t, map[string]sarama.KError{
+		"my_topic": sarama.ErrInvalidReplicationFactor,
+	})
+	defer broker.Close()
+
+	config := NewConfig()
+	config.Brokers = []string{broker.Addr()}
+	config.Topic = null.StringFrom("my_topic")
+	config.CreateTopic.Enabled = null.BoolFrom(true)
+	err := newPreflightTestOutput(t, config).createTopics()
+	require.ErrorIs(t, err, sarama.ErrInvalidReplicationFactor)
+	assert.Contains(t, err.Error(), `couldn't create the "my_topic" Kafka topic`)
+}
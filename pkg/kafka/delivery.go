@@ -0,0 +1,117 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// The supported values of the acks option.
+const (
+	acksNone  = "0"
+	acksLocal = "1"
+	acksAll   = "all"
+)
+
+func (c Config) validateDelivery() error {
+	acks, err := c.requiredAcks()
+	if err != nil {
+		return err
+	}
+	if c.RetryMax.Int64 < 0 {
+		return fmt.Errorf("retryMax can't be negative but was %d", c.RetryMax.Int64)
+	}
+	if c.RetryBackoff.Valid && time.Duration(c.RetryBackoff.Duration) < 0 {
+		return fmt.Errorf("retryBackoff can't be negative but was %s", c.RetryBackoff.Duration)
+	}
+	if c.MaxOpenRequests.Valid && c.MaxOpenRequests.Int64 <= 0 {
+		return fmt.Errorf("maxOpenRequests should be positive but was %d", c.MaxOpenRequests.Int64)
+	}
+	if c.Timeout.Valid && time.Duration(c.Timeout.Duration) <= 0 {
+		return fmt.Errorf("timeout should be positive but was %s", c.Timeout.Duration)
+	}
+
+	if !c.Idempotent.Bool && !c.Transactional.Bool {
+		return nil
+	}
+	if c.Acks.Valid && acks != sarama.WaitForAll {
+		return fmt.Errorf("idempotent requires acks=%s but acks is %s", acksAll, c.Acks.String)
+	}
+	if c.MaxOpenRequests.Valid && c.MaxOpenRequests.Int64 != 1 {
+		return fmt.Errorf("idempotent requires maxOpenRequests=1 but maxOpenRequests is %d", c.MaxOpenRequests.Int64)
+	}
+	if c.RetryMax.Valid && c.RetryMax.Int64 == 0 {
+		return errors.New("idempotent requires retryMax to be at least 1")
+	}
+	return c.requireVersion(sarama.V0_11_0_0, "idempotent")
+}
+
+// requiredAcks returns the configured acknowledgements the brokers have to
+// send back, only the leader's by default.
+func (c Config) requiredAcks() (sarama.RequiredAcks, error) {
+	switch c.Acks.String {
+	case acksNone:
+		return sarama.NoResponse, nil
+	case "", acksLocal:
+		return sarama.WaitForLocal, nil
+	case acksAll, "-1":
+		return sarama.WaitForAll, nil
+	default:
+		return sarama.WaitForLocal, fmt.Errorf("invalid acks (%s), it should be one of 0, 1 or all", c.Acks.String)
+	}
+}
+
+// applyDelivery sets the producer options about how messages are acknowledged
+// and retried. Idempotence implies acks=all and a single in-flight request per
+// broker, so those are the defaults when it's enabled, and transactions imply
+// idempotence.
+func (c Config) applyDelivery(saramaConfig *sarama.Config) error {
+	acks, err := c.requiredAcks()
+	if err != nil {
+		return err
+	}
+	saramaConfig.Producer.RequiredAcks = acks
+	if c.Transactional.Bool {
+		saramaConfig.Producer.Transaction.ID = c.transactionalID()
+	}
+	if c.Idempotent.Bool || c.Transactional.Bool {
+		saramaConfig.Producer.Idempotent = true
+		saramaConfig.Producer.RequiredAcks = sarama.WaitForAll
+		saramaConfig.Net.MaxOpenRequests = 1
+	}
+	if c.RetryMax.Valid {
+		saramaConfig.Producer.Retry.Max = int(c.RetryMax.Int64)
+	}
+	if c.RetryBackoff.Valid {
+		saramaConfig.Producer.Retry.Backoff = time.Duration(c.RetryBackoff.Duration)
+	}
+	if c.MaxOpenRequests.Valid {
+		saramaConfig.Net.MaxOpenRequests = int(c.MaxOpenRequests.Int64)
+	}
+	if c.Timeout.Valid {
+		saramaConfig.Producer.Timeout = time.Duration(c.Timeout.Duration)
+	}
+	return nil
+}
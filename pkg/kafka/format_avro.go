@@ -0,0 +1,110 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	_ "embed" // for the bundled Avro schema
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"go.k6.io/k6/metrics"
+)
+
+// avroSampleSchema is the Avro schema every sample is encoded against.
+//
+//go:embed schema/sample.avsc
+var avroSampleSchema string
+
+// avroMetricType returns the index of the symbol in the MetricType enum of
+// avroSampleSchema that matches the k6 metric type.
+func avroMetricType(t metrics.MetricType) (int64, error) {
+	switch t {
+	case metrics.Counter:
+		return 0, nil
+	case metrics.Gauge:
+		return 1, nil
+	case metrics.Trend:
+		return 2, nil
+	case metrics.Rate:
+		return 3, nil
+	default:
+		return 0, fmt.Errorf("unsupported metric type %s", t)
+	}
+}
+
+// formatAsAvro encodes the sample in Avro binary encoding, framed with the
+// Schema Registry wire format header for the given schema ID.
+func formatAsAvro(schemaID int, sample metrics.Sample) ([]byte, error) {
+	metricType, err := avroMetricType(sample.Metric.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 0, 128)
+	b = appendSchemaRegistryHeader(b, schemaID)
+	b = appendAvroString(b, sample.Metric.Name)
+	b = appendAvroLong(b, metricType)
+	b = appendAvroLong(b, sample.Time.UnixMicro())
+	b = appendAvroDouble(b, sample.Value)
+	if sample.Tags != nil {
+		b = appendAvroStringMap(b, sample.Tags.Map())
+	} else {
+		b = appendAvroStringMap(b, nil)
+	}
+	b = appendAvroStringMap(b, sample.Metadata)
+	return b, nil
+}
+
+// appendAvroLong appends v as a zig-zag encoded variable-length integer, which
+// is how Avro encodes both int and long values.
+func appendAvroLong(b []byte, v int64) []byte {
+	return binary.AppendVarint(b, v)
+}
+
+func appendAvroDouble(b []byte, v float64) []byte {
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+func appendAvroString(b []byte, s string) []byte {
+	b = appendAvroLong(b, int64(len(s)))
+	return append(b, s...)
+}
+
+// appendAvroStringMap appends m as a single block of sorted entries followed by
+// the zero-length block that ends every Avro map.
+func appendAvroStringMap(b []byte, m map[string]string) []byte {
+	if len(m) > 0 {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b = appendAvroLong(b, int64(len(keys)))
+		for _, k := range keys {
+			b = appendAvroString(b, k)
+			b = appendAvroString(b, m[k])
+		}
+	}
+	return appendAvroLong(b, 0)
+}
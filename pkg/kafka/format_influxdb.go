@@ -21,58 +21,155 @@
 package kafka
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
-	client "github.com/influxdata/influxdb1-client/v2"
 	"github.com/sirupsen/logrus"
 	"go.k6.io/k6/metrics"
+	"gopkg.in/guregu/null.v3"
 )
 
 type extractTagsToValuesFunc func(map[string]string, map[string]interface{}) map[string]interface{}
 
-// format returns a string array of metrics in influx line-protocol
-func formatAsInfluxdbV1(
+// formatAsInfluxdbLines returns a string array of metrics in influx line-protocol,
+// with the timestamps in the given precision.
+func formatAsInfluxdbLines(
 	logger logrus.FieldLogger, samples []metrics.Sample, extractTagsToValues extractTagsToValuesFunc,
+	precision time.Duration,
 ) ([]string, error) {
-	m := make([]string, 0)
+	m := make([]string, 0, len(samples))
+	// the tags and the fields extracted from them are encoded once per tag set
 	type cacheItem struct {
-		tags   map[string]string
-		values map[string]interface{}
+		tags   string
+		fields string
 	}
 	cache := map[*metrics.TagSet]cacheItem{}
+	var buf bytes.Buffer
 	for _, sample := range samples {
-		var tags map[string]string
-		values := make(map[string]interface{})
-		if cached, ok := cache[sample.Tags]; ok {
-			tags = cached.tags
-			for k, v := range cached.values {
-				values[k] = v
+		cached, ok := cache[sample.Tags]
+		if !ok {
+			var tags map[string]string
+			if sample.Tags != nil {
+				tags = sample.Tags.Map()
+			} else {
+				tags = map[string]string{}
 			}
-		} else {
-			tags = sample.Tags.Map()
-			extractTagsToValues(tags, values)
-			cache[sample.Tags] = cacheItem{tags, values}
+			values := extractTagsToValues(tags, make(map[string]interface{}))
+			cached = cacheItem{tags: encodeInfluxdbTags(tags), fields: encodeInfluxdbFields(values)}
+			cache[sample.Tags] = cached
 		}
-		values["value"] = sample.Value
-		p, err := client.NewPoint(
-			sample.Metric.Name,
-			tags,
-			values,
-			sample.Time,
-		)
-		if err != nil {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			err := fmt.Errorf("invalid value %v for metric %s", sample.Value, sample.Metric.Name)
 			logger.WithError(err).Error("InfluxDB: Couldn't make point from sample!")
 			return nil, err
 		}
-		m = append(m, p.String())
+
+		buf.Reset()
+		writeInfluxdbEscaped(&buf, sample.Metric.Name, ", ")
+		buf.WriteString(cached.tags)
+		buf.WriteString(" value=")
+		buf.WriteString(strconv.FormatFloat(sample.Value, 'f', -1, 64))
+		buf.WriteString(cached.fields)
+		if !sample.Time.IsZero() {
+			buf.WriteByte(' ')
+			buf.WriteString(strconv.FormatInt(sample.Time.UnixNano()/int64(precision), 10))
+		}
+		m = append(m, buf.String())
 	}
 
 	return m, nil
 }
 
+// encodeInfluxdbTags returns the tag set part of a line, sorted by key and
+// without the tags with an empty value, which line protocol doesn't allow.
+func encodeInfluxdbTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k != "" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.WriteByte(',')
+		writeInfluxdbEscaped(&buf, k, ",= ")
+		buf.WriteByte('=')
+		writeInfluxdbEscaped(&buf, tags[k], ",= ")
+	}
+	return buf.String()
+}
+
+// encodeInfluxdbFields returns the fields extracted from the tags, each one
+// preceded by a comma so they can follow the value field.
+func encodeInfluxdbFields(values map[string]interface{}) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.WriteByte(',')
+		writeInfluxdbEscaped(&buf, k, ",= ")
+		buf.WriteByte('=')
+		switch v := values[k].(type) {
+		case float64:
+			buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		case int64:
+			buf.WriteString(strconv.FormatInt(v, 10))
+			buf.WriteByte('i')
+		case bool:
+			buf.WriteString(strconv.FormatBool(v))
+		default:
+			buf.WriteByte('"')
+			writeInfluxdbEscaped(&buf, fmt.Sprint(v), `"\`)
+			buf.WriteByte('"')
+		}
+	}
+	return buf.String()
+}
+
+// writeInfluxdbEscaped writes s with a backslash before every character in
+// special. Newlines can't be escaped in line protocol, so they're written as \n.
+func writeInfluxdbEscaped(buf *bytes.Buffer, s string, special string) {
+	for _, r := range s {
+		switch {
+		case r == '\n':
+			buf.WriteString(`\n`)
+			continue
+		case strings.ContainsRune(special, r):
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(r)
+	}
+}
+
+// influxdbPrecision returns the duration a timestamp is expressed in for the
+// given line protocol precision.
+func influxdbPrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "ns":
+		return time.Nanosecond, nil
+	case "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	default:
+		return 0, fmt.Errorf("invalid InfluxDB precision (%s), it should be one of ns, us, ms or s", precision)
+	}
+}
+
 // FieldKind defines Enum for tag-to-field type conversion
 type FieldKind int
 
@@ -164,6 +261,9 @@ func (c influxdbConfig) Apply(cfg influxdbConfig) influxdbConfig {
 	if len(cfg.TagsAsFields) > 0 {
 		c.TagsAsFields = cfg.TagsAsFields
 	}
+	if cfg.Precision.Valid {
+		c.Precision = cfg.Precision
+	}
 	return c
 }
 
@@ -178,6 +278,10 @@ func influxdbParseMap(m map[string]interface{}) (influxdbConfig, error) {
 		c.TagsAsFields = interfaceSliceToStringSlice(v)
 		delete(m, "tagsAsFields")
 	}
+	if v, ok := m["precision"].(string); ok {
+		c.Precision = null.StringFrom(v)
+		delete(m, "precision")
+	}
 	if len(m) > 0 {
 		return c, errors.New("Unknown or unparsed options '" + mapToString(m) + "'")
 	}
@@ -185,7 +289,8 @@ func influxdbParseMap(m map[string]interface{}) (influxdbConfig, error) {
 }
 
 type influxdbConfig struct {
-	TagsAsFields []string `json:"tagsAsFields,omitempty" envconfig:"K6_INFLUXDB_TAGS_AS_FIELDS"`
+	TagsAsFields []string    `json:"tagsAsFields,omitempty" envconfig:"K6_INFLUXDB_TAGS_AS_FIELDS"`
+	Precision    null.String `json:"precision,omitempty" envconfig:"K6_INFLUXDB_PRECISION"`
 }
 
 func newInfluxdbConfig() influxdbConfig {
@@ -0,0 +1,395 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"go.k6.io/k6/lib/consts"
+	"go.k6.io/k6/metrics"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	otlpScopeName              = "k6"
+	otlpAggregationTemporality = 1 // AGGREGATION_TEMPORALITY_DELTA
+)
+
+type otlpConfig struct {
+	// Attributes are the resource attributes of the metrics, like service.name.
+	Attributes map[string]string `json:"resourceAttributes,omitempty" envconfig:"K6_KAFKA_OTLP_RESOURCE_ATTRIBUTES"`
+}
+
+func (c otlpConfig) Apply(cfg otlpConfig) otlpConfig {
+	if len(cfg.Attributes) > 0 {
+		c.Attributes = cfg.Attributes
+	}
+	return c
+}
+
+// otlpParseMap parses a map[string]interface{} into an otlpConfig
+func otlpParseMap(m map[string]interface{}) (otlpConfig, error) {
+	c := otlpConfig{}
+	if v, ok := m["resourceAttributes"].(map[string]interface{}); ok {
+		c.Attributes = make(map[string]string, len(v))
+		for k, attr := range v {
+			c.Attributes[k] = fmt.Sprintf("%v", attr)
+		}
+		delete(m, "resourceAttributes")
+	}
+	if len(m) > 0 {
+		return c, errors.New("Unknown or unparsed options '" + mapToString(m) + "'")
+	}
+	return c, nil
+}
+
+// formatAsOTLP encodes the samples as a single OTLP ExportMetricsServiceRequest,
+// in the protobuf encoding or, if asJSON is set, in the OTLP/JSON encoding.
+//
+// Every sample becomes a data point of its own: counters are mapped to
+// monotonic delta sums, gauges and rates to gauges and trends to delta
+// histograms with a single observation. The test run ID, when set, becomes
+// the k6.test_run_id resource attribute.
+func formatAsOTLP(config otlpConfig, testRunID string, samples []metrics.Sample, asJSON bool) ([]byte, error) {
+	request, err := newOTLPRequest(config, testRunID, samples)
+	if err != nil {
+		return nil, err
+	}
+	if asJSON {
+		return json.Marshal(request)
+	}
+	return request.appendProto(nil), nil
+}
+
+func newOTLPRequest(config otlpConfig, testRunID string, samples []metrics.Sample) (*otlpRequest, error) {
+	resourceAttributes := map[string]string{
+		"service.name":    "k6",
+		"service.version": consts.Version,
+	}
+	if testRunID != "" {
+		resourceAttributes["k6.test_run_id"] = testRunID
+	}
+	for k, v := range config.Attributes {
+		resourceAttributes[k] = v
+	}
+
+	var metricsList []*otlpMetric
+	byName := make(map[string]*otlpMetric)
+	for _, sample := range samples {
+		metric, ok := byName[sample.Metric.Name]
+		if !ok {
+			metric = newOTLPMetric(sample.Metric)
+			byName[sample.Metric.Name] = metric
+			metricsList = append(metricsList, metric)
+		}
+
+		var attributes []otlpKeyValue
+		if sample.Tags != nil {
+			attributes = newOTLPAttributes(sample.Tags.Map())
+		}
+		timestamp := uint64(sample.Time.UnixNano())
+
+		switch sample.Metric.Type {
+		case metrics.Counter:
+			metric.Sum.DataPoints = append(metric.Sum.DataPoints, otlpNumberDataPoint{
+				Attributes: attributes, StartTimeUnixNano: timestamp, TimeUnixNano: timestamp, AsDouble: sample.Value,
+			})
+		case metrics.Gauge, metrics.Rate:
+			metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, otlpNumberDataPoint{
+				Attributes: attributes, TimeUnixNano: timestamp, AsDouble: sample.Value,
+			})
+		case metrics.Trend:
+			metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, otlpHistogramDataPoint{
+				Attributes: attributes, StartTimeUnixNano: timestamp, TimeUnixNano: timestamp,
+				Count: 1, Sum: sample.Value, BucketCounts: otlpUint64s{1}, Min: sample.Value, Max: sample.Value,
+			})
+		default:
+			return nil, fmt.Errorf("unsupported metric type %s", sample.Metric.Type)
+		}
+	}
+
+	return &otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: newOTLPAttributes(resourceAttributes)},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: otlpScopeName, Version: consts.Version},
+			Metrics: metricsList,
+		}},
+	}}}, nil
+}
+
+func newOTLPMetric(m *metrics.Metric) *otlpMetric {
+	metric := &otlpMetric{Name: m.Name}
+	switch m.Contains {
+	case metrics.Time:
+		metric.Unit = "ms"
+	case metrics.Data:
+		metric.Unit = "By"
+	case metrics.Default:
+	}
+
+	switch m.Type {
+	case metrics.Counter:
+		metric.Sum = &otlpSum{AggregationTemporality: otlpAggregationTemporality, IsMonotonic: true}
+	case metrics.Gauge, metrics.Rate:
+		metric.Gauge = &otlpGauge{}
+	case metrics.Trend:
+		metric.Histogram = &otlpHistogram{AggregationTemporality: otlpAggregationTemporality}
+	}
+	return metric
+}
+
+func newOTLPAttributes(m map[string]string) []otlpKeyValue {
+	attributes := make([]otlpKeyValue, 0, len(m))
+	for k, v := range m {
+		attributes = append(attributes, otlpKeyValue{Key: k, Value: otlpAnyValue{StringValue: v}})
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].Key < attributes[j].Key })
+	return attributes
+}
+
+// The types below mirror the messages of opentelemetry/proto/collector/metrics/v1
+// that k6 samples are mapped onto. The JSON tags follow the OTLP/JSON encoding
+// and the appendProto methods the field numbers of the protobuf definitions.
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+func (r *otlpRequest) appendProto(b []byte) []byte {
+	for _, rm := range r.ResourceMetrics {
+		b = appendOTLPMessage(b, 1, rm.appendProto(nil))
+	}
+	return b
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+func (rm otlpResourceMetrics) appendProto(b []byte) []byte {
+	b = appendOTLPMessage(b, 1, rm.Resource.appendProto(nil))
+	for _, sm := range rm.ScopeMetrics {
+		b = appendOTLPMessage(b, 2, sm.appendProto(nil))
+	}
+	return b
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+func (r otlpResource) appendProto(b []byte) []byte {
+	return appendOTLPAttributes(b, 1, r.Attributes)
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+func (sm otlpScopeMetrics) appendProto(b []byte) []byte {
+	b = appendOTLPMessage(b, 1, sm.Scope.appendProto(nil))
+	for _, m := range sm.Metrics {
+		b = appendOTLPMessage(b, 2, m.appendProto(nil))
+	}
+	return b
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+func (s otlpScope) appendProto(b []byte) []byte {
+	b = appendOTLPString(b, 1, s.Name)
+	return appendOTLPString(b, 2, s.Version)
+}
+
+type otlpMetric struct {
+	Name      string         `json:"name"`
+	Unit      string         `json:"unit,omitempty"`
+	Gauge     *otlpGauge     `json:"gauge,omitempty"`
+	Sum       *otlpSum       `json:"sum,omitempty"`
+	Histogram *otlpHistogram `json:"histogram,omitempty"`
+}
+
+func (m *otlpMetric) appendProto(b []byte) []byte {
+	b = appendOTLPString(b, 1, m.Name)
+	b = appendOTLPString(b, 3, m.Unit)
+	switch {
+	case m.Gauge != nil:
+		b = appendOTLPMessage(b, 5, m.Gauge.appendProto(nil))
+	case m.Sum != nil:
+		b = appendOTLPMessage(b, 7, m.Sum.appendProto(nil))
+	case m.Histogram != nil:
+		b = appendOTLPMessage(b, 9, m.Histogram.appendProto(nil))
+	}
+	return b
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+func (g *otlpGauge) appendProto(b []byte) []byte {
+	for _, dp := range g.DataPoints {
+		b = appendOTLPMessage(b, 1, dp.appendProto(nil))
+	}
+	return b
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+func (s *otlpSum) appendProto(b []byte) []byte {
+	for _, dp := range s.DataPoints {
+		b = appendOTLPMessage(b, 1, dp.appendProto(nil))
+	}
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(s.AggregationTemporality))
+	if s.IsMonotonic {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	return b
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+func (h *otlpHistogram) appendProto(b []byte) []byte {
+	for _, dp := range h.DataPoints {
+		b = appendOTLPMessage(b, 1, dp.appendProto(nil))
+	}
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(h.AggregationTemporality))
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64         `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64         `json:"timeUnixNano,string"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+func (dp otlpNumberDataPoint) appendProto(b []byte) []byte {
+	b = appendOTLPFixed64(b, 2, dp.StartTimeUnixNano)
+	b = appendOTLPFixed64(b, 3, dp.TimeUnixNano)
+	b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(dp.AsDouble))
+	return appendOTLPAttributes(b, 7, dp.Attributes)
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64         `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64         `json:"timeUnixNano,string"`
+	Count             uint64         `json:"count,string"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      otlpUint64s    `json:"bucketCounts"`
+	Min               float64        `json:"min"`
+	Max               float64        `json:"max"`
+}
+
+func (dp otlpHistogramDataPoint) appendProto(b []byte) []byte {
+	b = appendOTLPFixed64(b, 2, dp.StartTimeUnixNano)
+	b = appendOTLPFixed64(b, 3, dp.TimeUnixNano)
+	b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, dp.Count)
+	b = protowire.AppendTag(b, 5, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(dp.Sum))
+
+	packed := make([]byte, 0, 8*len(dp.BucketCounts))
+	for _, c := range dp.BucketCounts {
+		packed = protowire.AppendFixed64(packed, c)
+	}
+	b = appendOTLPMessage(b, 6, packed)
+
+	b = appendOTLPAttributes(b, 9, dp.Attributes)
+	b = protowire.AppendTag(b, 11, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(dp.Min))
+	b = protowire.AppendTag(b, 12, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(dp.Max))
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpUint64s is a list of 64-bit integers, which OTLP/JSON encodes as strings.
+type otlpUint64s []uint64
+
+func (u otlpUint64s) MarshalJSON() ([]byte, error) {
+	s := make([]string, len(u))
+	for i, v := range u {
+		s[i] = strconv.FormatUint(v, 10)
+	}
+	return json.Marshal(s)
+}
+
+func appendOTLPMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendOTLPString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendOTLPFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func appendOTLPAttributes(b []byte, num protowire.Number, attributes []otlpKeyValue) []byte {
+	for _, kv := range attributes {
+		// string_value is part of a oneof, so it's written even when empty
+		value := protowire.AppendTag(nil, 1, protowire.BytesType)
+		value = protowire.AppendString(value, kv.Value.StringValue)
+		attribute := appendOTLPString(nil, 1, kv.Key)
+		attribute = appendOTLPMessage(attribute, 2, value)
+		b = appendOTLPMessage(b, num, attribute)
+	}
+	return b
+}
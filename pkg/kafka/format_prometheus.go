@@ -0,0 +1,155 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/golang/snappy"
+	"go.k6.io/k6/metrics"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const prometheusNamePrefix = "k6_"
+
+// prometheusEncoder encodes samples as Prometheus remote-write requests. It
+// keeps the running totals of counters, since k6 emits counter increments while
+// Prometheus expects cumulative values.
+type prometheusEncoder struct {
+	counters map[metrics.TimeSeries]float64
+}
+
+func newPrometheusEncoder() *prometheusEncoder {
+	return &prometheusEncoder{counters: make(map[metrics.TimeSeries]float64)}
+}
+
+type prometheusSeries struct {
+	labels  []prometheusLabel
+	samples []prometheusSample
+}
+
+type prometheusLabel struct {
+	name, value string
+}
+
+type prometheusSample struct {
+	value     float64
+	timestamp int64
+}
+
+// encode returns a snappy-compressed WriteRequest with a time series for every
+// distinct metric and tag set in samples.
+func (e *prometheusEncoder) encode(samples []metrics.Sample) []byte {
+	var seriesList []*prometheusSeries
+	byTimeSeries := make(map[metrics.TimeSeries]*prometheusSeries)
+	for _, sample := range samples {
+		series, ok := byTimeSeries[sample.TimeSeries]
+		if !ok {
+			series = &prometheusSeries{labels: prometheusLabels(sample)}
+			byTimeSeries[sample.TimeSeries] = series
+			seriesList = append(seriesList, series)
+		}
+
+		value := sample.Value
+		if sample.Metric.Type == metrics.Counter {
+			value += e.counters[sample.TimeSeries]
+			e.counters[sample.TimeSeries] = value
+		}
+		series.samples = append(series.samples, prometheusSample{value: value, timestamp: sample.Time.UnixMilli()})
+	}
+
+	var b []byte
+	for _, series := range seriesList {
+		// samples of a series have to be in chronological order
+		sort.SliceStable(series.samples, func(i, j int) bool {
+			return series.samples[i].timestamp < series.samples[j].timestamp
+		})
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, series.appendProto(nil))
+	}
+	return snappy.Encode(nil, b)
+}
+
+func (s *prometheusSeries) appendProto(b []byte) []byte {
+	for _, l := range s.labels {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, l.name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, l.value)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, label)
+	}
+	for _, s := range s.samples {
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestamp))
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, sample)
+	}
+	return b
+}
+
+// prometheusLabels returns the sorted labels of the sample's time series, the
+// metric name as __name__ and a label for every non-empty tag.
+func prometheusLabels(sample metrics.Sample) []prometheusLabel {
+	name := prometheusNamePrefix + sanitizePrometheusName(sample.Metric.Name, true)
+	if sample.Metric.Type == metrics.Counter {
+		name += "_total"
+	}
+	labels := []prometheusLabel{{name: "__name__", value: name}}
+	if sample.Tags != nil {
+		for k, v := range sample.Tags.Map() {
+			if v == "" {
+				continue
+			}
+			labels = append(labels, prometheusLabel{name: sanitizePrometheusName(k, false), value: v})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+// sanitizePrometheusName replaces every character that isn't valid in a
+// Prometheus metric name, or a label name if colons aren't allowed, with an
+// underscore.
+func sanitizePrometheusName(name string, allowColons bool) string {
+	var sb strings.Builder
+	sb.Grow(len(name) + 1)
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':' && allowColons:
+			sb.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				sb.WriteByte('_')
+			}
+			sb.WriteRune(r)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,116 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	_ "embed" // for the bundled .proto contract
+	"fmt"
+	"math"
+	"sort"
+
+	"go.k6.io/k6/metrics"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobufSampleSchema is the .proto contract of the protobuf format, it's
+// also what gets registered when the Schema Registry framing is enabled.
+//
+//go:embed schema/sample.proto
+var protobufSampleSchema string
+
+// Field numbers of the Sample message in protobufSampleSchema.
+const (
+	protobufSampleMetric       protowire.Number = 1
+	protobufSampleType         protowire.Number = 2
+	protobufSampleValue        protowire.Number = 3
+	protobufSampleTimeUnixNano protowire.Number = 4
+	protobufSampleTags         protowire.Number = 5
+	protobufSampleMetadata     protowire.Number = 6
+)
+
+// protobufMetricType returns the value of the MetricType enum in
+// protobufSampleSchema that matches the k6 metric type.
+func protobufMetricType(t metrics.MetricType) (uint64, error) {
+	switch t {
+	case metrics.Counter:
+		return 1, nil
+	case metrics.Gauge:
+		return 2, nil
+	case metrics.Trend:
+		return 3, nil
+	case metrics.Rate:
+		return 4, nil
+	default:
+		return 0, fmt.Errorf("unsupported metric type %s", t)
+	}
+}
+
+// formatAsProtobuf encodes the sample as a Sample message. With a positive
+// schemaID, it's prefixed with the Schema Registry wire format header.
+func formatAsProtobuf(schemaID int, sample metrics.Sample) ([]byte, error) {
+	metricType, err := protobufMetricType(sample.Metric.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 0, 128)
+	if schemaID > 0 {
+		b = appendSchemaRegistryHeader(b, schemaID)
+		// the message indexes of the first message in the schema
+		b = append(b, 0)
+	}
+
+	b = protowire.AppendTag(b, protobufSampleMetric, protowire.BytesType)
+	b = protowire.AppendString(b, sample.Metric.Name)
+	b = protowire.AppendTag(b, protobufSampleType, protowire.VarintType)
+	b = protowire.AppendVarint(b, metricType)
+	b = protowire.AppendTag(b, protobufSampleValue, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(sample.Value))
+	b = protowire.AppendTag(b, protobufSampleTimeUnixNano, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(sample.Time.UnixNano()))
+	if sample.Tags != nil {
+		b = appendProtobufStringMap(b, protobufSampleTags, sample.Tags.Map())
+	}
+	b = appendProtobufStringMap(b, protobufSampleMetadata, sample.Metadata)
+	return b, nil
+}
+
+// appendProtobufStringMap appends m as a map<string, string> field, i.e. a
+// repeated message with the key as field 1 and the value as field 2.
+func appendProtobufStringMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := m[k]
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendVarint(b, uint64(
+			protowire.SizeTag(1)+protowire.SizeBytes(len(k))+protowire.SizeTag(2)+protowire.SizeBytes(len(v))))
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, k)
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	return b
+}
@@ -0,0 +1,132 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"errors"
+
+	"github.com/Shopify/sarama"
+	"gopkg.in/guregu/null.v3"
+)
+
+// The defaults of the Kerberos config file and of the service name the
+// brokers run as.
+const (
+	defaultKerberosConfig      = "/etc/krb5.conf"
+	defaultKerberosServiceName = "kafka"
+)
+
+type gssapiConfig struct {
+	KeyTab          null.String `json:"keyTab" envconfig:"K6_KAFKA_GSSAPI_KEYTAB"`
+	KerberosConfig  null.String `json:"kerberosConfig" envconfig:"K6_KAFKA_GSSAPI_KERBEROS_CONFIG"`
+	ServiceName     null.String `json:"serviceName" envconfig:"K6_KAFKA_GSSAPI_SERVICE_NAME"`
+	Realm           null.String `json:"realm" envconfig:"K6_KAFKA_GSSAPI_REALM"`
+	DisablePAFXFAST null.Bool   `json:"disablePAFXFAST" envconfig:"K6_KAFKA_GSSAPI_DISABLE_PA_FX_FAST"`
+}
+
+func (c gssapiConfig) Apply(cfg gssapiConfig) gssapiConfig {
+	if cfg.KeyTab.Valid {
+		c.KeyTab = cfg.KeyTab
+	}
+	if cfg.KerberosConfig.Valid {
+		c.KerberosConfig = cfg.KerberosConfig
+	}
+	if cfg.ServiceName.Valid {
+		c.ServiceName = cfg.ServiceName
+	}
+	if cfg.Realm.Valid {
+		c.Realm = cfg.Realm
+	}
+	if cfg.DisablePAFXFAST.Valid {
+		c.DisablePAFXFAST = cfg.DisablePAFXFAST
+	}
+	return c
+}
+
+// gssapiParseMap parses a map[string]interface{} into a gssapiConfig
+func gssapiParseMap(m map[string]interface{}) (gssapiConfig, error) {
+	c := gssapiConfig{}
+	if v, ok := m["keyTab"].(string); ok {
+		c.KeyTab = null.StringFrom(v)
+		delete(m, "keyTab")
+	}
+	if v, ok := m["kerberosConfig"].(string); ok {
+		c.KerberosConfig = null.StringFrom(v)
+		delete(m, "kerberosConfig")
+	}
+	if v, ok := m["serviceName"].(string); ok {
+		c.ServiceName = null.StringFrom(v)
+		delete(m, "serviceName")
+	}
+	if v, ok := m["realm"].(string); ok {
+		c.Realm = null.StringFrom(v)
+		delete(m, "realm")
+	}
+	if v, ok := m["disablePAFXFAST"].(bool); ok {
+		c.DisablePAFXFAST = null.BoolFrom(v)
+		delete(m, "disablePAFXFAST")
+	}
+	if len(m) > 0 {
+		return c, errors.New("Unknown or unparsed options '" + mapToString(m) + "'")
+	}
+	return c, nil
+}
+
+func (c Config) validateGSSAPI() error {
+	if c.AuthMechanism.String != "gssapi" {
+		return nil
+	}
+	if !c.hasUser() {
+		return errors.New("user is required for the gssapi auth mechanism")
+	}
+	if !c.GSSAPI.KeyTab.Valid && !c.hasPassword() {
+		return errors.New("gssapi.keyTab or password is required for the gssapi auth mechanism")
+	}
+	if !c.GSSAPI.Realm.Valid {
+		return errors.New("gssapi.realm is required for the gssapi auth mechanism")
+	}
+	return nil
+}
+
+// applyGSSAPI sets the Kerberos options of the gssapi auth mechanism, logging
+// in with the keytab if there's one and with the password otherwise.
+func (c Config) applyGSSAPI(saramaConfig *sarama.Config, user, password string) {
+	gssapi := sarama.GSSAPIConfig{
+		AuthType:           sarama.KRB5_USER_AUTH,
+		KerberosConfigPath: defaultKerberosConfig,
+		ServiceName:        defaultKerberosServiceName,
+		Username:           user,
+		Password:           password,
+		Realm:              c.GSSAPI.Realm.String,
+		DisablePAFXFAST:    c.GSSAPI.DisablePAFXFAST.Bool,
+	}
+	if c.GSSAPI.KeyTab.Valid {
+		gssapi.AuthType = sarama.KRB5_KEYTAB_AUTH
+		gssapi.KeyTabPath = c.GSSAPI.KeyTab.String
+	}
+	if c.GSSAPI.KerberosConfig.Valid {
+		gssapi.KerberosConfigPath = c.GSSAPI.KerberosConfig.String
+	}
+	if c.GSSAPI.ServiceName.Valid {
+		gssapi.ServiceName = c.GSSAPI.ServiceName.String
+	}
+	saramaConfig.Net.SASL.GSSAPI = gssapi
+}
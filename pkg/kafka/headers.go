@@ -0,0 +1,96 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/Shopify/sarama"
+	"go.k6.io/k6/lib/consts"
+	"go.k6.io/k6/metrics"
+)
+
+// The names of the headers set on the messages when headers are enabled.
+const (
+	headerMetric        = "k6-metric"
+	headerMetricType    = "k6-metric-type"
+	headerFormat        = "k6-format"
+	headerContentType   = "content-type"
+	headerSchemaVersion = "k6-schema-version"
+	headerK6Version     = "k6-version"
+	headerTestRunID     = "k6-test-run-id"
+)
+
+// schemaVersion is the version of the message formats, it matches the version
+// of the bundled Avro and protobuf schemas.
+const schemaVersion = "1"
+
+// contentType returns the MIME type of the messages in the given format.
+func contentType(format string) string {
+	switch format {
+	case "influxdb":
+		return "text/plain"
+	case "avro":
+		return "application/avro"
+	case "protobuf", "otlp_proto", "prometheus_remote_write":
+		return "application/x-protobuf"
+	default:
+		return "application/json"
+	}
+}
+
+// newTestRunID returns a random ID for the test run, used when none is configured.
+func newTestRunID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// commonHeaders returns the headers shared by all the messages, nil if
+// headers aren't enabled.
+func (c Config) commonHeaders() []sarama.RecordHeader {
+	if !c.Headers.Bool {
+		return nil
+	}
+	return []sarama.RecordHeader{
+		{Key: []byte(headerFormat), Value: []byte(c.Format.String)},
+		{Key: []byte(headerContentType), Value: []byte(contentType(c.Format.String))},
+		{Key: []byte(headerSchemaVersion), Value: []byte(schemaVersion)},
+		{Key: []byte(headerK6Version), Value: []byte(consts.Version)},
+		{Key: []byte(headerTestRunID), Value: []byte(c.TestRunID.String)},
+	}
+}
+
+// sampleHeaders returns the headers of a message with a single sample.
+func sampleHeaders(common []sarama.RecordHeader, sample metrics.Sample) []sarama.RecordHeader {
+	if common == nil {
+		return nil
+	}
+	headers := make([]sarama.RecordHeader, 0, len(common)+2)
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(headerMetric), Value: []byte(sample.Metric.Name)},
+		sarama.RecordHeader{Key: []byte(headerMetricType), Value: []byte(sample.Metric.Type.String())},
+	)
+	return append(headers, common...)
+}
@@ -0,0 +1,122 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"go.k6.io/k6/metrics"
+)
+
+// The supported values of the key option.
+const (
+	keyNone   = "none"
+	keyMetric = "metric"
+	keySeries = "series"
+	keyTags   = "tags"
+)
+
+func validateKey(key string, tags []string) error {
+	switch key {
+	case "", keyNone, keyMetric, keySeries:
+		return nil
+	case keyTags:
+		if len(tags) == 0 {
+			return fmt.Errorf("keyTags is required when key is %s", keyTags)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid key (%s), it should be one of none, metric, series or tags", key)
+	}
+}
+
+// messageKeys builds the keys of the messages, caching them per time series
+// since most samples of a flush share a handful of them.
+type messageKeys struct {
+	key   string
+	tags  []string
+	cache map[metrics.TimeSeries]sarama.Encoder
+}
+
+func newMessageKeys(key string, tags []string) *messageKeys {
+	return &messageKeys{key: key, tags: tags, cache: make(map[metrics.TimeSeries]sarama.Encoder)}
+}
+
+// forSample returns the key of the message with the sample, nil if messages
+// shouldn't have keys.
+func (k *messageKeys) forSample(sample metrics.Sample) sarama.Encoder {
+	if k == nil {
+		return nil
+	}
+	switch k.key {
+	case keyMetric:
+		return sarama.StringEncoder(sample.Metric.Name)
+	case keySeries, keyTags:
+	default:
+		return nil
+	}
+
+	if key, ok := k.cache[sample.TimeSeries]; ok {
+		return key
+	}
+	var tags map[string]string
+	if sample.Tags != nil {
+		tags = sample.Tags.Map()
+	}
+
+	var key sarama.Encoder
+	if k.key == keySeries {
+		key = sarama.StringEncoder(seriesHash(sample.Metric.Name, tags))
+	} else {
+		values := make([]string, len(k.tags))
+		for i, tag := range k.tags {
+			values[i] = tag + "=" + tags[tag]
+		}
+		key = sarama.StringEncoder(strings.Join(values, ","))
+	}
+	k.cache[sample.TimeSeries] = key
+	return key
+}
+
+// seriesHash returns the hex-encoded FNV-1a hash of the metric name and all the
+// tags, sorted by name.
+func seriesHash(metric string, tags map[string]string) string {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(metric))
+	for _, name := range names {
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(name))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(tags[name]))
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
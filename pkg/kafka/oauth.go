@@ -0,0 +1,348 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.k6.io/k6/lib/fsext"
+	"gopkg.in/guregu/null.v3"
+)
+
+const (
+	// oauthRequestTimeout is how long a token request can take, sarama expects
+	// the token provider to fail rather than block.
+	oauthRequestTimeout = 10 * time.Second
+
+	// oauthTokenFileRefresh is how often a token file is re-read when the token
+	// doesn't tell when it expires.
+	oauthTokenFileRefresh = time.Minute
+)
+
+type oauthConfig struct {
+	Token            null.String       `json:"token" envconfig:"K6_KAFKA_OAUTH_TOKEN"`
+	TokenFile        null.String       `json:"tokenFile" envconfig:"K6_KAFKA_OAUTH_TOKEN_FILE"`
+	TokenURL         null.String       `json:"tokenURL" envconfig:"K6_KAFKA_OAUTH_TOKEN_URL"`
+	ClientID         null.String       `json:"clientID" envconfig:"K6_KAFKA_OAUTH_CLIENT_ID"`
+	ClientSecret     null.String       `json:"clientSecret" envconfig:"K6_KAFKA_OAUTH_CLIENT_SECRET"`
+	ClientSecretFile null.String       `json:"clientSecretFile" envconfig:"K6_KAFKA_OAUTH_CLIENT_SECRET_FILE"`
+	Scopes           []string          `json:"scopes,omitempty" envconfig:"K6_KAFKA_OAUTH_SCOPES"`
+	Extensions       map[string]string `json:"extensions,omitempty" envconfig:"K6_KAFKA_OAUTH_EXTENSIONS"`
+}
+
+func (c oauthConfig) Apply(cfg oauthConfig) oauthConfig {
+	if cfg.Token.Valid {
+		c.Token = cfg.Token
+	}
+	if cfg.TokenFile.Valid {
+		c.TokenFile = cfg.TokenFile
+	}
+	if cfg.TokenURL.Valid {
+		c.TokenURL = cfg.TokenURL
+	}
+	if cfg.ClientID.Valid {
+		c.ClientID = cfg.ClientID
+	}
+	if cfg.ClientSecret.Valid {
+		c.ClientSecret = cfg.ClientSecret
+	}
+	if cfg.ClientSecretFile.Valid {
+		c.ClientSecretFile = cfg.ClientSecretFile
+	}
+	if len(cfg.Scopes) > 0 {
+		c.Scopes = cfg.Scopes
+	}
+	if len(cfg.Extensions) > 0 {
+		c.Extensions = cfg.Extensions
+	}
+	return c
+}
+
+// oauthParseMap parses a map[string]interface{} into an oauthConfig
+func oauthParseMap(m map[string]interface{}) (oauthConfig, error) {
+	c := oauthConfig{}
+	if v, ok := m["token"].(string); ok {
+		c.Token = null.StringFrom(v)
+		delete(m, "token")
+	}
+	if v, ok := m["tokenFile"].(string); ok {
+		c.TokenFile = null.StringFrom(v)
+		delete(m, "tokenFile")
+	}
+	if v, ok := m["tokenURL"].(string); ok {
+		c.TokenURL = null.StringFrom(v)
+		delete(m, "tokenURL")
+	}
+	if v, ok := m["clientID"].(string); ok {
+		c.ClientID = null.StringFrom(v)
+		delete(m, "clientID")
+	}
+	if v, ok := m["clientSecret"].(string); ok {
+		c.ClientSecret = null.StringFrom(v)
+		delete(m, "clientSecret")
+	}
+	if v, ok := m["clientSecretFile"].(string); ok {
+		c.ClientSecretFile = null.StringFrom(v)
+		delete(m, "clientSecretFile")
+	}
+	if v, ok := m["scopes"].(string); ok {
+		c.Scopes = []string{v}
+		delete(m, "scopes")
+	}
+	if v, ok := m["scopes"].([]interface{}); ok {
+		c.Scopes = interfaceSliceToStringSlice(v)
+		delete(m, "scopes")
+	}
+	if v, ok := m["extensions"].(map[string]interface{}); ok {
+		c.Extensions = make(map[string]string, len(v))
+		for k, extension := range v {
+			c.Extensions[k] = fmt.Sprintf("%v", extension)
+		}
+		delete(m, "extensions")
+	}
+	if len(m) > 0 {
+		return c, errors.New("Unknown or unparsed options '" + mapToString(m) + "'")
+	}
+	return c, nil
+}
+
+func (c Config) validateOAuth() error {
+	if c.AuthMechanism.String != "oauthbearer" {
+		return nil
+	}
+	sources := 0
+	for _, source := range []null.String{c.OAuth.Token, c.OAuth.TokenFile, c.OAuth.TokenURL} {
+		if source.Valid {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New("exactly one of oauth.token, oauth.tokenFile or oauth.tokenURL is required " +
+			"for the oauthbearer auth mechanism")
+	}
+	if c.OAuth.TokenURL.Valid &&
+		(!c.OAuth.ClientID.Valid || (!c.OAuth.ClientSecret.Valid && !c.OAuth.ClientSecretFile.Valid)) {
+		return errors.New("oauth.clientID and oauth.clientSecret are required with oauth.tokenURL")
+	}
+	if len(c.OAuth.Extensions) > 0 {
+		return c.requireVersion(sarama.V2_1_0_0, "oauth.extensions")
+	}
+	return c.requireVersion(sarama.V2_0_0_0, "oauthbearer")
+}
+
+// tokenSource fetches an access token, and when it expires. A zero expiry
+// means the token doesn't expire.
+type tokenSource interface {
+	fetchToken() (string, time.Time, error)
+}
+
+// newTokenSource returns the source of the tokens configured in c.
+func newTokenSource(c oauthConfig, fs fsext.Fs) tokenSource {
+	switch {
+	case c.TokenFile.Valid:
+		return &fileTokenSource{fs: fs, path: c.TokenFile.String, now: time.Now}
+	case c.TokenURL.Valid:
+		return &clientCredentialsTokenSource{
+			tokenURL:     c.TokenURL.String,
+			clientID:     c.ClientID.String,
+			clientSecret: func() (string, error) { return readSecret(fs, c.ClientSecret, c.ClientSecretFile) },
+			scopes:       c.Scopes,
+			httpClient:   &http.Client{Timeout: oauthRequestTimeout},
+			now:          time.Now,
+		}
+	default:
+		return staticTokenSource(c.Token.String)
+	}
+}
+
+// staticTokenSource is a token that never changes.
+type staticTokenSource string
+
+func (s staticTokenSource) fetchToken() (string, time.Time, error) {
+	return string(s), time.Time{}, nil
+}
+
+// fileTokenSource reads the token from a file that's rotated by someone else.
+// The file is read again when the token expires, according to its exp claim
+// if it's a JWT.
+type fileTokenSource struct {
+	fs   fsext.Fs
+	path string
+	now  func() time.Time
+}
+
+func (s *fileTokenSource) fetchToken() (string, time.Time, error) {
+	b, err := fsext.ReadFile(s.fs, s.path)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("couldn't read oauth.tokenFile: %w", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", time.Time{}, fmt.Errorf("oauth.tokenFile (%s) is empty", s.path)
+	}
+	expiry, ok := jwtExpiry(token)
+	if !ok {
+		expiry = s.now().Add(oauthTokenFileRefresh)
+	}
+	return token, expiry, nil
+}
+
+// jwtExpiry returns the time of the exp claim of a JWT, false if the token
+// isn't a JWT or has no exp claim.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
+// clientCredentialsTokenSource gets tokens from an OAuth2 token endpoint with
+// the client credentials grant.
+type clientCredentialsTokenSource struct {
+	tokenURL     string
+	clientID     string
+	clientSecret func() (string, error)
+	scopes       []string
+	httpClient   *http.Client
+	now          func() time.Time
+}
+
+type oauthTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (s *clientCredentialsTokenSource) fetchToken() (string, time.Time, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.scopes) > 0 {
+		form.Set("scope", strings.Join(s.scopes, " "))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oauthRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	clientSecret, err := s.clientSecret()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.SetBasicAuth(url.QueryEscape(s.clientID), url.QueryEscape(clientSecret))
+
+	requestTime := s.now()
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("requesting an OAuth token failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var response oauthTokenResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", time.Time{}, fmt.Errorf("unexpected OAuth token response with status %d: %s", resp.StatusCode, body)
+	}
+	if resp.StatusCode != http.StatusOK || response.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("requesting an OAuth token failed with status %d: %s %s",
+			resp.StatusCode, response.Error, response.ErrorDescription)
+	}
+
+	var expiry time.Time
+	if response.ExpiresIn > 0 {
+		expiry = requestTime.Add(time.Duration(response.ExpiresIn) * time.Second)
+	} else if jwtExp, ok := jwtExpiry(response.AccessToken); ok {
+		expiry = jwtExp
+	}
+	return response.AccessToken, expiry, nil
+}
+
+// oauthTokenProvider is the sarama.AccessTokenProvider of the oauthbearer auth
+// mechanism. It reuses the token from its source until 80% of its lifetime
+// has passed, so connections and re-authentications during long tests always
+// get a fresh one.
+type oauthTokenProvider struct {
+	source     tokenSource
+	extensions map[string]string
+	now        func() time.Time
+
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time
+}
+
+var _ sarama.AccessTokenProvider = &oauthTokenProvider{}
+
+func newOAuthTokenProvider(c oauthConfig, fs fsext.Fs) *oauthTokenProvider {
+	return &oauthTokenProvider{
+		source:     newTokenSource(c, fs),
+		extensions: c.Extensions,
+		now:        time.Now,
+	}
+}
+
+// Token implements sarama.AccessTokenProvider.
+func (p *oauthTokenProvider) Token() (*sarama.AccessToken, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if p.token == "" || (!p.refreshAt.IsZero() && !now.Before(p.refreshAt)) {
+		token, expiry, err := p.source.fetchToken()
+		if err != nil {
+			return nil, err
+		}
+		p.token = token
+		p.refreshAt = time.Time{}
+		if !expiry.IsZero() {
+			p.refreshAt = now.Add(expiry.Sub(now) * 8 / 10)
+		}
+	}
+	return &sarama.AccessToken{Token: p.token, Extensions: p.extensions}, nil
+}
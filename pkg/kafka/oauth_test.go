@@ -0,0 +1,151 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/lib/fsext"
+	"gopkg.in/guregu/null.v3"
+)
+
+// testClock is a clock that only moves when it's told to.
+type testClock struct{ now time.Time }
+
+func (c *testClock) Now() time.Time { return c.now }
+
+func newTestJWT(exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":"k6","exp":%d}`, exp.Unix())))
+	return "eyJhbGciOiJub25lIn0." + payload + ".sig"
+}
+
+func TestOAuthTokenProviderClientCredentials(t *testing.T) {
+	t.Parallel()
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&requests, 1)
+		user, password, _ := r.BasicAuth()
+		if user != "k6" || password != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = fmt.Fprint(w, `{"error":"invalid_client","error_description":"bad credentials"}`)
+			return
+		}
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "kafka metrics:write", r.PostForm.Get("scope"))
+		_, _ = fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":3600}`, n)
+	}))
+	defer server.Close()
+
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	config := oauthConfig{
+		TokenURL:     null.StringFrom(server.URL),
+		ClientID:     null.StringFrom("k6"),
+		ClientSecret: null.StringFrom("s3cret"),
+		Scopes:       []string{"kafka", "metrics:write"},
+		Extensions:   map[string]string{"logicalCluster": "lkc-1"},
+	}
+	provider := newOAuthTokenProvider(config, fsext.NewMemMapFs())
+	provider.now = clock.Now
+	provider.source.(*clientCredentialsTokenSource).now = clock.Now //nolint:forcetypeassert
+
+	token, err := provider.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token.Token)
+	assert.Equal(t, map[string]string{"logicalCluster": "lkc-1"}, token.Extensions)
+
+	// the token is reused while it's fresh
+	clock.now = clock.now.Add(45 * time.Minute)
+	token, err = provider.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token.Token)
+
+	// and refreshed before it expires
+	clock.now = clock.now.Add(5 * time.Minute)
+	token, err = provider.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token.Token)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&requests))
+
+	config.ClientSecret = null.StringFrom("wrong")
+	_, err = newOAuthTokenProvider(config, fsext.NewMemMapFs()).Token()
+	require.ErrorContains(t, err, "status 401: invalid_client bad credentials")
+}
+
+func TestOAuthTokenProviderTokenFile(t *testing.T) {
+	t.Parallel()
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	fs := fsext.NewMemMapFs()
+	firstToken := newTestJWT(clock.now.Add(10 * time.Minute))
+	require.NoError(t, fsext.WriteFile(fs, "/run/token", []byte(firstToken+"\n"), 0o600))
+
+	provider := newOAuthTokenProvider(oauthConfig{TokenFile: null.StringFrom("/run/token")}, fs)
+	provider.now = clock.Now
+	provider.source.(*fileTokenSource).now = clock.Now //nolint:forcetypeassert
+
+	token, err := provider.Token()
+	require.NoError(t, err)
+	assert.Equal(t, firstToken, token.Token)
+
+	// the rotated file is only read once the token is about to expire
+	secondToken := newTestJWT(clock.now.Add(20 * time.Minute))
+	require.NoError(t, fsext.WriteFile(fs, "/run/token", []byte(secondToken), 0o600))
+	clock.now = clock.now.Add(5 * time.Minute)
+	token, err = provider.Token()
+	require.NoError(t, err)
+	assert.Equal(t, firstToken, token.Token)
+
+	clock.now = clock.now.Add(4 * time.Minute)
+	token, err = provider.Token()
+	require.NoError(t, err)
+	assert.Equal(t, secondToken, token.Token)
+
+	// opaque tokens are read again every minute
+	require.NoError(t, fsext.WriteFile(fs, "/run/opaque", []byte("opaque-1"), 0o600))
+	provider = newOAuthTokenProvider(oauthConfig{TokenFile: null.StringFrom("/run/opaque")}, fs)
+	provider.now = clock.Now
+	provider.source.(*fileTokenSource).now = clock.Now //nolint:forcetypeassert
+	token, err = provider.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "opaque-1", token.Token)
+	require.NoError(t, fsext.WriteFile(fs, "/run/opaque", []byte("opaque-2"), 0o600))
+	clock.now = clock.now.Add(time.Minute)
+	token, err = provider.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "opaque-2", token.Token)
+}
+
+func TestOAuthTokenProviderStaticToken(t *testing.T) {
+	t.Parallel()
+	provider := newOAuthTokenProvider(oauthConfig{Token: null.StringFrom("static")}, nil)
+	token, err := provider.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "static", token.Token)
+	assert.Nil(t, token.Extensions)
+}
@@ -24,31 +24,72 @@ package kafka
 import (
 	"crypto/sha256"
 	"crypto/sha512"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/sirupsen/logrus"
+	"go.k6.io/k6/lib/fsext"
 	"go.k6.io/k6/metrics"
 	"go.k6.io/k6/output"
+	"gopkg.in/guregu/null.v3"
 )
 
-const flushPeriod = 1 * time.Second
-
 // Output is a k6 output that sends metrics to a Kafka broker.
 type Output struct {
 	output.SampleBuffer
 
 	periodicFlusher *output.PeriodicFlusher
+	flushMu         sync.Mutex
+	flushSignal     chan struct{}
+	flushDone       chan struct{}
+	flushWg         sync.WaitGroup
+
+	// bufferedSamples and bufferedBytes track what was added since the last
+	// flush, they are only updated when a size-triggered flush is configured.
+	bufferedSamples int64
+	bufferedBytes   int64
+
+	router            *topicRouter
+	keys              *messageKeys
+	prometheusEncoder *prometheusEncoder
+
+	// schemaID is the Schema Registry ID of the schema the samples are encoded
+	// with, it's only set for formats that use the registry.
+	schemaID int
 
 	Config   Config
 	CloseFn  func() error
 	logger   logrus.FieldLogger
 	Producer sarama.AsyncProducer
 	errorsWg sync.WaitGroup
+	fs       fsext.Fs
+	stats    *deliveryStats
+
+	// failures tracks the deliveries for the stopTest policy, which stops the
+	// test run with testRunStop.
+	failures    *failureTracker
+	testRunStop func(error)
+
+	// spool keeps the messages that couldn't be delivered, when spool.dir is
+	// set, and replayProducer replays them.
+	spool          *spool
+	replayProducer sarama.SyncProducer
+	spoolDone      chan struct{}
+	spoolWg        sync.WaitGroup
+
+	// queue holds the messages of the flushes until the producer takes them,
+	// transactions are produced without it.
+	queue  *messageQueue
+	sendWg sync.WaitGroup
+
+	// newClusterAdmin connects the cluster admin that creates the topics and
+	// runs the preflight check.
+	newClusterAdmin func() (sarama.ClusterAdmin, error)
 }
 
 // New creates a new instance of the output.
@@ -62,50 +103,132 @@ func newOutput(params output.Params) (*Output, error) {
 		return nil, err
 	}
 
-	producer, err := newProducer(config)
+	if !config.TestRunID.Valid {
+		testRunID, err := newTestRunID()
+		if err != nil {
+			return nil, err
+		}
+		config.TestRunID = null.StringFrom(testRunID)
+	}
+	params.Logger.WithField("config", config).Debug("Kafka: Creating the output...")
+
+	router, err := newTopicRouter(config.Routes, config.Topic.String)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Output{
+	fs := params.FS
+	if fs == nil {
+		fs = fsext.NewOsFs()
+	}
+	producer, err := newProducer(config, fs, params.Environment)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Output{
 		Producer: producer,
 		logger:   params.Logger,
 		Config:   config,
-	}, nil
+		fs:       fs,
+		router:   router,
+		keys:     newMessageKeys(config.Key.String, config.KeyTags),
+		newClusterAdmin: func() (sarama.ClusterAdmin, error) {
+			return newClusterAdmin(config, fs, params.Environment)
+		},
+	}
+	if config.Spool.Dir.Valid {
+		if o.spool, err = openSpool(fs, config.Spool); err != nil {
+			_ = producer.Close()
+			return nil, err
+		}
+		if o.replayProducer, err = newReplayProducer(config, fs, params.Environment); err != nil {
+			_ = producer.Close()
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func newProducer(config Config, fs fsext.Fs, env map[string]string) (sarama.AsyncProducer, error) {
+	saramaConfig, err := newSaramaConfig(config, fs, env)
+	if err != nil {
+		return nil, err
+	}
+	return sarama.NewAsyncProducer(config.Brokers, saramaConfig)
 }
 
-func newProducer(config Config) (sarama.AsyncProducer, error) {
+// newSaramaConfig translates the output's config into the client config of
+// sarama, the files it refers to are read from fs and env has the environment
+// variables of the standard credential sources.
+func newSaramaConfig(config Config, fs fsext.Fs, env map[string]string) (*sarama.Config, error) {
 	saramaConfig := sarama.NewConfig()
-	saramaConfig.Producer.Return.Errors = config.LogError.Bool
+	// the successes and errors are read for the delivery report, and to spool
+	// the messages that couldn't be delivered
+	saramaConfig.Producer.Return.Successes = true
+	saramaConfig.Producer.Return.Errors = true
+	if config.MaxMessageBytes.Valid {
+		saramaConfig.Producer.MaxMessageBytes = int(config.MaxMessageBytes.Int64)
+	}
+	codec, err := config.compressionCodec()
+	if err != nil {
+		return nil, err
+	}
+	saramaConfig.Producer.Compression = codec
+	if config.CompressionLevel.Valid {
+		saramaConfig.Producer.CompressionLevel = int(config.CompressionLevel.Int64)
+	}
+	if err := config.applyDelivery(saramaConfig); err != nil {
+		return nil, err
+	}
+
+	if config.SSL.Bool {
+		tlsConfig, tlsErr := newTLSConfig(config, fs)
+		if tlsErr != nil {
+			return nil, tlsErr
+		}
+		saramaConfig.Net.TLS.Enable = true
+		saramaConfig.Net.TLS.Config = tlsConfig
+	}
 
 	saramaAuthMechanism := config.AuthMechanism.String
 
 	if saramaAuthMechanism != "none" {
 		saramaConfig.Net.SASL.Enable = true
 		saramaConfig.Net.SASL.Handshake = true
-		saramaConfig.Net.SASL.User = config.User.String
-		saramaConfig.Net.SASL.Password = config.Password.String
-		if config.SSL.Bool {
-			saramaConfig.Net.TLS.Enable = true
-			// #nosec G402
-			saramaConfig.Net.TLS.Config = &tls.Config{
-				InsecureSkipVerify: config.InsecureSkipTLSVerify.Bool,
-				ClientAuth:         0,
-			}
+		credentials := config.saslCredentials(fs)
+		user, password, credentialsErr := credentials()
+		if credentialsErr != nil {
+			return nil, credentialsErr
 		}
+		saramaConfig.Net.SASL.User = user
+		saramaConfig.Net.SASL.Password = password
 		switch saramaAuthMechanism {
 		case "plain":
 			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypePlaintext
 		case "scram-sha-512":
 			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
 			saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
-				return &xDGSCRAMClient{HashGeneratorFcn: sha512.New}
+				return &xDGSCRAMClient{HashGeneratorFcn: sha512.New, credentials: credentials}
 			}
 		case "scram-sha-256":
 			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
 			saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
-				return &xDGSCRAMClient{HashGeneratorFcn: sha256.New}
+				return &xDGSCRAMClient{HashGeneratorFcn: sha256.New, credentials: credentials}
+			}
+		case "oauthbearer":
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeOAuth
+			saramaConfig.Net.SASL.TokenProvider = newOAuthTokenProvider(config.OAuth, fs)
+		case "aws-msk-iam":
+			tokenProvider, providerErr := newMSKIAMTokenProvider(config.AWS, env, fs)
+			if providerErr != nil {
+				return nil, providerErr
 			}
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeOAuth
+			saramaConfig.Net.SASL.TokenProvider = tokenProvider
+		case "gssapi":
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeGSSAPI
+			config.applyGSSAPI(saramaConfig, user, password)
 		}
 	}
 
@@ -116,34 +239,138 @@ func newProducer(config Config) (sarama.AsyncProducer, error) {
 
 	saramaConfig.Version = version
 
-	return sarama.NewAsyncProducer(config.Brokers, saramaConfig)
+	return saramaConfig, nil
 }
 
 // Description returns a short human-readable description of the output.
 func (o *Output) Description() string {
+	if len(o.Config.Routes) > 0 {
+		return fmt.Sprintf("xk6-Kafka: Kafka Async output on topic %v with routes %v",
+			o.Config.Topic.String, strings.Join(o.Config.Routes, ", "))
+	}
 	return fmt.Sprintf("xk6-Kafka: Kafka Async output on topic %v", o.Config.Topic.String)
 }
 
 // Start initializes the output.
 func (o *Output) Start() error {
-	// TODO get the period on the config
-	periodicFlusher, err := output.NewPeriodicFlusher(flushPeriod, o.flushMetrics)
+	if err := o.createTopics(); err != nil {
+		return err
+	}
+	if err := o.preflight(); err != nil {
+		return err
+	}
+	if err := o.registerSchema(); err != nil {
+		return err
+	}
+
+	// everything flushMetrics uses is set up before the flushes can start
+	o.stats = newDeliveryStats()
+	o.failures = newFailureTracker(o.Config.StopTest)
+	if !o.Producer.IsTransactional() {
+		o.startSending()
+	}
+
+	o.flushSignal = make(chan struct{}, 1)
+	o.flushDone = make(chan struct{})
+	o.flushWg.Add(1)
+	go func() {
+		defer o.flushWg.Done()
+		for {
+			select {
+			case <-o.flushSignal:
+				o.logger.Debug("Kafka: Buffer limit reached, flushing early...")
+				o.flushMetrics()
+			case <-o.flushDone:
+				return
+			}
+		}
+	}()
+
+	o.readDeliveries()
+	if o.spool != nil {
+		o.startSpoolReplay()
+	}
+
+	periodicFlusher, err := output.NewPeriodicFlusher(time.Duration(o.Config.PushInterval.Duration), o.flushMetrics)
 	if err != nil {
 		return err
 	}
 	o.periodicFlusher = periodicFlusher
+	return nil
+}
 
-	if o.Config.LogError.Bool {
-		o.errorsWg.Add(1)
-		go func() {
-			// Errors is the error output channel back to the user. You MUST read from this
-			// channel or the Producer will deadlock when the channel is full.
-			// reference: https://pkg.go.dev/github.com/shopify/sarama#AsyncProducer
-			for err := range o.Producer.Errors() {
+// readDeliveries reads the errors and successes of the producer, counting the
+// messages and spooling those that failed. The messages of transactions are
+// counted, and spooled when they fail, once their transaction is committed or
+// aborted.
+func (o *Output) readDeliveries() {
+	transactional := o.Producer.IsTransactional()
+	o.errorsWg.Add(2)
+	go func() {
+		// Errors is the error output channel back to the user. You MUST read from this
+		// channel or the Producer will deadlock when the channel is full.
+		// reference: https://pkg.go.dev/github.com/shopify/sarama#AsyncProducer
+		for err := range o.Producer.Errors() {
+			if o.Config.LogError.Bool {
 				o.logger.WithError(err.Err).Error("Kafka: failed to send message.")
 			}
-			o.errorsWg.Done()
-		}()
+			if transactional {
+				continue
+			}
+			o.stats.failed(err.Msg)
+			o.recordDelivery(err.Err)
+			switch {
+			case o.spool == nil:
+			case isRetriableDeliveryError(err.Err):
+				o.spoolMessages(err.Msg)
+			default:
+				o.logger.WithError(err.Err).WithField("topic", err.Msg.Topic).
+					Warn("Kafka: Dropping a message that can't be delivered instead of spooling it")
+			}
+		}
+		o.errorsWg.Done()
+	}()
+	go func() {
+		// like Errors, Successes must be read too
+		for message := range o.Producer.Successes() {
+			if !transactional {
+				o.stats.acked(message)
+				o.recordDelivery(nil)
+			}
+		}
+		o.errorsWg.Done()
+	}()
+}
+
+// registerSchema resolves the Schema Registry ID of the schema used by the
+// configured format, registering the schema if needed.
+func (o *Output) registerSchema() error {
+	var schemaType, schema string
+	switch o.Config.Format.String {
+	case "avro":
+		schema = avroSampleSchema
+	case "protobuf":
+		if !o.Config.SchemaRegistry.URL.Valid {
+			return nil
+		}
+		schemaType, schema = "PROTOBUF", protobufSampleSchema
+	default:
+		return nil
+	}
+
+	registry := newSchemaRegistryClient(o.Config.SchemaRegistry, o.fs)
+	for _, subject := range o.Config.schemaRegistrySubjects(o.router.topics()) {
+		schemaID, err := registry.schemaID(subject, schemaType, schema)
+		if err != nil {
+			return err
+		}
+		if o.schemaID != 0 && o.schemaID != schemaID {
+			return fmt.Errorf("the schema has different IDs (%d and %d) for the subjects of the routed topics",
+				o.schemaID, schemaID)
+		}
+		o.logger.WithField("schemaID", schemaID).WithField("subject", subject).
+			Debug("Kafka: Using the registered schema")
+		o.schemaID = schemaID
 	}
 	return nil
 }
@@ -152,24 +379,140 @@ func (o *Output) Start() error {
 func (o *Output) Stop() error {
 	o.logger.Debug("Kafka: Stopping...")
 	defer o.logger.Debug("Kafka: Stopped!")
+	close(o.flushDone)
+	o.flushWg.Wait()
 	o.periodicFlusher.Stop()
+	if o.queue != nil {
+		o.stopSending()
+	}
+	o.abortPendingTransaction()
 	o.Producer.AsyncClose()
 	o.errorsWg.Wait()
+	if o.spool != nil {
+		o.stopSpool()
+	}
+	o.reportDelivery()
 
 	return nil
 }
 
-func (o *Output) batchFromBufferedSamples(bufferedSamples []metrics.SampleContainer) ([]string, error) {
-	var formattedSamples []string
+// AddMetricSamples buffers the samples and, when flushMaxSamples or
+// flushMaxBytes is configured, triggers a flush as soon as the samples buffered
+// since the last flush pass either limit.
+func (o *Output) AddMetricSamples(containers []metrics.SampleContainer) {
+	o.SampleBuffer.AddMetricSamples(containers)
+
+	maxSamples, maxBytes := o.Config.FlushMaxSamples.Int64, o.Config.FlushMaxBytes.Int64
+	if maxSamples <= 0 && maxBytes <= 0 {
+		return
+	}
+
+	var count, size int64
+	for _, container := range containers {
+		samples := container.GetSamples()
+		count += int64(len(samples))
+		if maxBytes > 0 {
+			for _, sample := range samples {
+				size += approximateSampleSize(sample)
+			}
+		}
+	}
+
+	count = atomic.AddInt64(&o.bufferedSamples, count)
+	size = atomic.AddInt64(&o.bufferedBytes, size)
+	if (maxSamples > 0 && count >= maxSamples) || (maxBytes > 0 && size >= maxBytes) {
+		select {
+		case o.flushSignal <- struct{}{}:
+		default: // a flush is already pending
+		}
+	}
+}
+
+// approximateSampleSize estimates how many bytes a sample takes once it's
+// formatted, without actually formatting it.
+func approximateSampleSize(sample metrics.Sample) int64 {
+	size := int64(len(sample.Metric.Name)) + 16 // value and time
+	if sample.Tags != nil {
+		for k, v := range sample.Tags.Map() {
+			size += int64(len(k) + len(v))
+		}
+	}
+	for k, v := range sample.Metadata {
+		size += int64(len(k) + len(v))
+	}
+	return size
+}
+
+// batchFromBufferedSamples formats the buffered samples into the messages to
+// produce, grouped by the topic every sample is routed to.
+func (o *Output) batchFromBufferedSamples(
+	bufferedSamples []metrics.SampleContainer,
+) ([]*sarama.ProducerMessage, error) {
+	var topics []string
+	samplesByTopic := make(map[string][]metrics.Sample)
 	for _, bufferedSample := range bufferedSamples {
-		samples := bufferedSample.GetSamples()
-		formatSamples, err := o.formatSamples(samples)
-		if err != nil {
-			return nil, err
+		for _, sample := range bufferedSample.GetSamples() {
+			topic := o.router.topic(sample.Metric)
+			if _, ok := samplesByTopic[topic]; !ok {
+				topics = append(topics, topic)
+			}
+			samplesByTopic[topic] = append(samplesByTopic[topic], sample)
+		}
+	}
+
+	headers := o.Config.commonHeaders()
+	var messages []*sarama.ProducerMessage
+	for _, topic := range topics {
+		samples := samplesByTopic[topic]
+		switch o.Config.Format.String {
+		case "otlp_proto", "otlp_json", "prometheus_remote_write":
+			// these payloads hold all the samples of a flush
+			payload, err := o.formatFlush(samples)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, &sarama.ProducerMessage{
+				Topic:     topic,
+				Value:     sarama.ByteEncoder(payload),
+				Headers:   headers,
+				Timestamp: messageTimestamp(o.Config.Timestamp.String, samples),
+				Metadata:  o.queue.priority(samples),
+			})
+		default:
+			// formatted samples are in the same order as samples
+			formattedSamples, err := o.formatSamples(samples)
+			if err != nil {
+				return nil, err
+			}
+			if batch := o.Config.Batch.String; batch == batchLines || batch == batchArray {
+				messages = append(messages, o.packMessages(topic, samples, formattedSamples, headers)...)
+				continue
+			}
+			for i, formattedSample := range formattedSamples {
+				messages = append(messages, &sarama.ProducerMessage{
+					Topic:     topic,
+					Key:       o.keys.forSample(samples[i]),
+					Value:     sarama.StringEncoder(formattedSample),
+					Headers:   sampleHeaders(headers, samples[i]),
+					Timestamp: messageTimestamp(o.Config.Timestamp.String, samples[i:i+1]),
+					Metadata:  o.queue.priority(samples[i : i+1]),
+				})
+			}
 		}
-		formattedSamples = append(formattedSamples, formatSamples...)
 	}
-	return formattedSamples, nil
+	return messages, nil
+}
+
+// formatFlush encodes all the samples of a flush into a single payload, for the
+// formats that batch samples on their own.
+func (o *Output) formatFlush(samples []metrics.Sample) ([]byte, error) {
+	if o.Config.Format.String == "prometheus_remote_write" {
+		if o.prometheusEncoder == nil {
+			o.prometheusEncoder = newPrometheusEncoder()
+		}
+		return o.prometheusEncoder.encode(samples), nil
+	}
+	return formatAsOTLP(o.Config.OTLPConfig, o.Config.TestRunID.String, samples, o.Config.Format.String == "otlp_json")
 }
 
 func (o *Output) formatSamples(samples metrics.Samples) ([]string, error) {
@@ -182,10 +525,32 @@ func (o *Output) formatSamples(samples metrics.Samples) ([]string, error) {
 		if err != nil {
 			return nil, err
 		}
-		metrics, err = formatAsInfluxdbV1(o.logger, samples, newExtractTagsFields(fieldKinds))
+		precision, err := influxdbPrecision(o.Config.InfluxDBConfig.Precision.String)
+		if err != nil {
+			return nil, err
+		}
+		metrics, err = formatAsInfluxdbLines(o.logger, samples, newExtractTagsFields(fieldKinds), precision)
 		if err != nil {
 			return nil, err
 		}
+	case "avro":
+		for _, sample := range samples {
+			metric, err := formatAsAvro(o.schemaID, sample)
+			if err != nil {
+				return nil, err
+			}
+
+			metrics = append(metrics, string(metric))
+		}
+	case "protobuf":
+		for _, sample := range samples {
+			metric, err := formatAsProtobuf(o.schemaID, sample)
+			if err != nil {
+				return nil, err
+			}
+
+			metrics = append(metrics, string(metric))
+		}
 	default:
 		for _, sample := range samples {
 			metric, err := json.Marshal(wrapSample(sample))
@@ -201,6 +566,11 @@ func (o *Output) formatSamples(samples metrics.Samples) ([]string, error) {
 }
 
 func (o *Output) flushMetrics() {
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+
+	atomic.StoreInt64(&o.bufferedSamples, 0)
+	atomic.StoreInt64(&o.bufferedBytes, 0)
 	bufferedSamples := o.GetBufferedSamples()
 
 	o.logger.Debug("Kafka: Converting the samples to messages...")
@@ -211,8 +581,19 @@ func (o *Output) flushMetrics() {
 
 	startTime := time.Now()
 	o.logger.Debug("Kafka: Delivering...")
-	for _, message := range messages {
-		o.Producer.Input() <- &sarama.ProducerMessage{Topic: o.Config.Topic.String, Value: sarama.StringEncoder(message)}
+	if o.Producer.IsTransactional() {
+		if len(messages) > 0 {
+			if err := o.produceInTransaction(messages); err != nil {
+				o.logger.WithError(err).Error("Kafka: Failed to deliver the messages in a transaction")
+				if o.spool != nil {
+					o.spoolMessages(messages...)
+				}
+			}
+		}
+	} else {
+		for _, message := range messages {
+			o.queue.push(message)
+		}
 	}
 	t := time.Since(startTime)
 	o.logger.WithField("t", t).Debug("Kafka: Delivered!")
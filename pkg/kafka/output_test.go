@@ -21,16 +21,26 @@
 package kafka
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/golang/snappy"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/lib/consts"
+	"go.k6.io/k6/lib/fsext"
 	"go.k6.io/k6/lib/testutils"
+	"go.k6.io/k6/lib/types"
 	"go.k6.io/k6/metrics"
 	"go.k6.io/k6/output"
+	"google.golang.org/protobuf/encoding/protowire"
 	"gopkg.in/guregu/null.v3"
 )
 
@@ -54,6 +64,71 @@ func TestRun(t *testing.T) {
 	require.NoError(t, c.Stop())
 }
 
+func TestNewSaramaConfigDelivery(t *testing.T) {
+	t.Parallel()
+
+	saramaConfig, err := newSaramaConfig(NewConfig(), fsext.NewMemMapFs(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, sarama.WaitForLocal, saramaConfig.Producer.RequiredAcks)
+	assert.False(t, saramaConfig.Producer.Idempotent)
+
+	config := NewConfig()
+	config.Version = null.StringFrom("2.8.0")
+	config.Idempotent = null.BoolFrom(true)
+	config.RetryMax = null.IntFrom(10)
+	config.RetryBackoff = types.NullDurationFrom(time.Second)
+	config.Timeout = types.NullDurationFrom(30 * time.Second)
+	saramaConfig, err = newSaramaConfig(config, fsext.NewMemMapFs(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, sarama.WaitForAll, saramaConfig.Producer.RequiredAcks)
+	assert.True(t, saramaConfig.Producer.Idempotent)
+	assert.Equal(t, 1, saramaConfig.Net.MaxOpenRequests)
+	assert.Equal(t, 10, saramaConfig.Producer.Retry.Max)
+	assert.Equal(t, time.Second, saramaConfig.Producer.Retry.Backoff)
+	assert.Equal(t, 30*time.Second, saramaConfig.Producer.Timeout)
+	require.NoError(t, saramaConfig.Validate())
+
+	config = NewConfig()
+	config.Acks = null.StringFrom("0")
+	saramaConfig, err = newSaramaConfig(config, fsext.NewMemMapFs(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, sarama.NoResponse, saramaConfig.Producer.RequiredAcks)
+}
+
+func TestNewSaramaConfigGSSAPI(t *testing.T) {
+	t.Parallel()
+
+	config := NewConfig()
+	config.AuthMechanism = null.StringFrom("gssapi")
+	config.User = null.StringFrom("k6")
+	config.GSSAPI.KeyTab = null.StringFrom("/etc/k6.keytab")
+	config.GSSAPI.Realm = null.StringFrom("EXAMPLE.COM")
+	config.GSSAPI.DisablePAFXFAST = null.BoolFrom(true)
+	saramaConfig, err := newSaramaConfig(config, fsext.NewMemMapFs(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, sarama.SASLMechanism(sarama.SASLTypeGSSAPI), saramaConfig.Net.SASL.Mechanism)
+	assert.Equal(t, sarama.GSSAPIConfig{
+		AuthType:           sarama.KRB5_KEYTAB_AUTH,
+		KeyTabPath:         "/etc/k6.keytab",
+		KerberosConfigPath: "/etc/krb5.conf",
+		ServiceName:        "kafka",
+		Username:           "k6",
+		Realm:              "EXAMPLE.COM",
+		DisablePAFXFAST:    true,
+	}, saramaConfig.Net.SASL.GSSAPI)
+	require.NoError(t, saramaConfig.Validate())
+
+	config.GSSAPI.KeyTab = null.String{}
+	config.Password = null.StringFrom("secret")
+	config.GSSAPI.ServiceName = null.StringFrom("kafka-prod")
+	saramaConfig, err = newSaramaConfig(config, fsext.NewMemMapFs(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, sarama.KRB5_USER_AUTH, saramaConfig.Net.SASL.GSSAPI.AuthType)
+	assert.Equal(t, "secret", saramaConfig.Net.SASL.GSSAPI.Password)
+	assert.Equal(t, "kafka-prod", saramaConfig.Net.SASL.GSSAPI.ServiceName)
+	require.NoError(t, saramaConfig.Validate())
+}
+
 func TestFormatSample(t *testing.T) {
 	t.Parallel()
 	o := Output{}
@@ -97,3 +172,767 @@ func TestFormatSample(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, []string{expJSON1, expJSON2}, formattedSamples)
 }
+
+func TestFlushOnMaxSamples(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("my_metric", metrics.Counter)
+	require.NoError(t, err)
+
+	delivered := make(chan struct{}, 3)
+	producer := mocks.NewAsyncProducer(t, nil)
+	for i := 0; i < 3; i++ {
+		producer.ExpectInputWithMessageCheckerFunctionAndSucceed(func(*sarama.ProducerMessage) error {
+			delivered <- struct{}{}
+			return nil
+		})
+	}
+
+	config := NewConfig()
+	config.Topic = null.StringFrom("my_topic")
+	config.PushInterval = types.NullDurationFrom(time.Hour)
+	config.FlushMaxSamples = null.IntFrom(2)
+	o := &Output{
+		Producer: producer,
+		logger:   testutils.NewLogger(t),
+		Config:   config,
+		router:   newTestTopicRouter(t),
+	}
+	require.NoError(t, o.Start())
+
+	sample := metrics.Sample{
+		TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()},
+		Value:      1,
+	}
+	o.AddMetricSamples([]metrics.SampleContainer{sample, sample})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-delivered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("samples were not flushed after reaching flushMaxSamples")
+		}
+	}
+
+	// below the limit, the sample waits for the final flush on Stop
+	o.AddMetricSamples([]metrics.SampleContainer{sample})
+	select {
+	case <-delivered:
+		t.Fatal("sample was flushed before reaching flushMaxSamples")
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.NoError(t, o.Stop())
+	assert.Len(t, delivered, 1)
+}
+
+func TestStartWithShortPushInterval(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("my_metric", metrics.Counter)
+	require.NoError(t, err)
+
+	delivered := make(chan struct{}, 1)
+	producer := mocks.NewAsyncProducer(t, nil)
+	producer.ExpectInputWithMessageCheckerFunctionAndSucceed(func(*sarama.ProducerMessage) error {
+		delivered <- struct{}{}
+		return nil
+	})
+
+	config := NewConfig()
+	config.Topic = null.StringFrom("my_topic")
+	config.PushInterval = types.NullDurationFrom(time.Microsecond)
+	o := &Output{
+		Producer: producer,
+		logger:   testutils.NewLogger(t),
+		Config:   config,
+		router:   newTestTopicRouter(t),
+	}
+
+	// the first flush can happen before Start returns
+	o.AddMetricSamples([]metrics.SampleContainer{metrics.Sample{
+		TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()},
+		Value:      1,
+	}})
+	require.NoError(t, o.Start())
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the sample wasn't flushed")
+	}
+	require.NoError(t, o.Stop())
+}
+
+// txnProducer is a transactional producer that records the transaction calls,
+// and how many messages were sent when each was made.
+type txnProducer struct {
+	sarama.AsyncProducer
+	input     chan *sarama.ProducerMessage
+	calls     []string
+	commitErr error
+	status    sarama.ProducerTxnStatusFlag
+}
+
+func (p *txnProducer) Input() chan<- *sarama.ProducerMessage { return p.input }
+func (p *txnProducer) IsTransactional() bool                 { return true }
+func (p *txnProducer) TxnStatus() sarama.ProducerTxnStatusFlag {
+	return p.status
+}
+
+func (p *txnProducer) BeginTxn() error {
+	p.calls = append(p.calls, fmt.Sprintf("begin:%d", len(p.input)))
+	p.status = sarama.ProducerTxnFlagInTransaction
+	return nil
+}
+
+func (p *txnProducer) CommitTxn() error {
+	p.calls = append(p.calls, fmt.Sprintf("commit:%d", len(p.input)))
+	if p.commitErr != nil {
+		p.status |= sarama.ProducerTxnFlagAbortableError
+		return p.commitErr
+	}
+	p.status = sarama.ProducerTxnFlagReady
+	return nil
+}
+
+func (p *txnProducer) AbortTxn() error {
+	p.calls = append(p.calls, fmt.Sprintf("abort:%d", len(p.input)))
+	p.status = sarama.ProducerTxnFlagReady
+	return nil
+}
+
+func TestFlushMetricsTransactional(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("my_metric", metrics.Counter)
+	require.NoError(t, err)
+	sample := metrics.Sample{
+		TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()},
+		Value:      1,
+	}
+
+	newTxnOutput := func(producer *txnProducer) *Output {
+		config := NewConfig()
+		config.Topic = null.StringFrom("my_topic")
+		return &Output{
+			Producer: producer,
+			logger:   testutils.NewLogger(t),
+			Config:   config,
+			router:   newTestTopicRouter(t),
+			keys:     newMessageKeys("", nil),
+		}
+	}
+
+	producer := &txnProducer{input: make(chan *sarama.ProducerMessage, 10)}
+	o := newTxnOutput(producer)
+	o.SampleBuffer.AddMetricSamples([]metrics.SampleContainer{sample, sample})
+	o.flushMetrics()
+	assert.Equal(t, []string{"begin:0", "commit:2"}, producer.calls)
+
+	// an empty flush doesn't open a transaction
+	o.flushMetrics()
+	assert.Equal(t, []string{"begin:0", "commit:2"}, producer.calls)
+
+	producer = &txnProducer{
+		input:     make(chan *sarama.ProducerMessage, 10),
+		commitErr: sarama.ErrOutOfOrderSequenceNumber,
+	}
+	o = newTxnOutput(producer)
+	o.SampleBuffer.AddMetricSamples([]metrics.SampleContainer{sample})
+	o.flushMetrics()
+	assert.Equal(t, []string{"begin:0", "commit:1", "abort:1"}, producer.calls)
+}
+
+func TestNewSaramaConfigTransactional(t *testing.T) {
+	t.Parallel()
+
+	config := NewConfig()
+	config.Version = null.StringFrom("2.8.0")
+	config.TestRunID = null.StringFrom("abc")
+	config.Transactional = null.BoolFrom(true)
+	saramaConfig, err := newSaramaConfig(config, fsext.NewMemMapFs(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "k6-abc", saramaConfig.Producer.Transaction.ID)
+	assert.True(t, saramaConfig.Producer.Idempotent)
+	require.NoError(t, saramaConfig.Validate())
+
+	config.TransactionalIDPrefix = null.StringFrom("reports")
+	saramaConfig, err = newSaramaConfig(config, fsext.NewMemMapFs(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "reports-abc", saramaConfig.Producer.Transaction.ID)
+}
+
+func TestFormatSampleAvro(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("my_metric", metrics.Trend)
+	require.NoError(t, err)
+
+	o := Output{schemaID: 7}
+	o.Config.Format = null.StringFrom("avro")
+	formattedSamples, err := o.formatSamples(metrics.Samples{{
+		TimeSeries: metrics.TimeSeries{
+			Metric: metric,
+			Tags:   registry.RootTagSet().WithTagsFromMap(map[string]string{"a": "1"}),
+		},
+		Time:     time.UnixMicro(1),
+		Value:    1.5,
+		Metadata: map[string]string{"trace_id": "x"},
+	}})
+	require.NoError(t, err)
+
+	expected := []byte{
+		0, 0, 0, 0, 7, // magic byte and schema ID
+		18, 'm', 'y', '_', 'm', 'e', 't', 'r', 'i', 'c', // metric
+		4,                            // type, TREND
+		2,                            // time
+		0, 0, 0, 0, 0, 0, 0xf8, 0x3f, // value
+		2, 2, 'a', 2, '1', 0, // tags
+		2, 16, 't', 'r', 'a', 'c', 'e', '_', 'i', 'd', 2, 'x', 0, // metadata
+	}
+	assert.Equal(t, []string{string(expected)}, formattedSamples)
+}
+
+func TestStartRegistersAvroSchema(t *testing.T) {
+	t.Parallel()
+	srv := newTestSchemaRegistry(t)
+
+	config := NewConfig()
+	config.Topic = null.StringFrom("my_topic")
+	config.Format = null.StringFrom("avro")
+	config.SchemaRegistry.URL = null.StringFrom(srv.URL)
+	config.SchemaRegistry.User = null.StringFrom("registry-user")
+	config.SchemaRegistry.Password = null.StringFrom("registry-password")
+	o := &Output{
+		Producer: mocks.NewAsyncProducer(t, nil),
+		logger:   testutils.NewLogger(t),
+		Config:   config,
+		router:   newTestTopicRouter(t),
+	}
+	require.NoError(t, o.Start())
+	assert.Equal(t, 42, o.schemaID)
+	require.NoError(t, o.Stop())
+}
+
+func TestFormatSampleProtobuf(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("my_metric", metrics.Rate)
+	require.NoError(t, err)
+
+	sample := metrics.Sample{
+		TimeSeries: metrics.TimeSeries{
+			Metric: metric,
+			Tags:   registry.RootTagSet().WithTagsFromMap(map[string]string{"a": "1", "b": "2"}),
+		},
+		Time:     time.Unix(0, 1500),
+		Value:    1,
+		Metadata: map[string]string{"trace_id": "x"},
+	}
+
+	o := Output{}
+	o.Config.Format = null.StringFrom("protobuf")
+	formattedSamples, err := o.formatSamples(metrics.Samples{sample})
+	require.NoError(t, err)
+	require.Len(t, formattedSamples, 1)
+
+	b := []byte(formattedSamples[0])
+	fields := map[protowire.Number][]interface{}{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			fields[num] = append(fields[num], v)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			fields[num] = append(fields[num], math.Float64frombits(v))
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			fields[num] = append(fields[num], string(v))
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+	}
+	assert.Equal(t, map[protowire.Number][]interface{}{
+		1: {"my_metric"},
+		2: {uint64(4)},
+		3: {1.0},
+		4: {uint64(1500)},
+		5: {"\n\x01a\x12\x011", "\n\x01b\x12\x012"},
+		6: {"\n\x08trace_id\x12\x01x"},
+	}, fields)
+
+	o.schemaID = 3
+	formattedSamples, err = o.formatSamples(metrics.Samples{sample})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 3, 0}, []byte(formattedSamples[0][:6]))
+}
+
+func TestBatchFromBufferedSamplesOTLP(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	counter, err := registry.NewMetric("my_counter", metrics.Counter)
+	require.NoError(t, err)
+	trend, err := registry.NewMetric("my_trend", metrics.Trend, metrics.Time)
+	require.NoError(t, err)
+
+	tags := registry.RootTagSet().WithTagsFromMap(map[string]string{"a": "1"})
+	containers := []metrics.SampleContainer{
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: counter, Tags: tags}, Time: time.Unix(0, 10), Value: 2},
+		metrics.Samples{
+			{TimeSeries: metrics.TimeSeries{Metric: trend, Tags: tags}, Time: time.Unix(0, 20), Value: 1.5},
+			{TimeSeries: metrics.TimeSeries{Metric: counter, Tags: tags}, Time: time.Unix(0, 30), Value: 1},
+		},
+	}
+
+	o := Output{router: newTestTopicRouter(t)}
+	o.Config.Format = null.StringFrom("otlp_json")
+	o.Config.OTLPConfig.Attributes = map[string]string{"service.name": "checkout"}
+	o.Config.TestRunID = null.StringFrom("run-42")
+	messages, err := o.batchFromBufferedSamples(containers)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+
+	attributes := `"attributes":[{"key":"a","value":{"stringValue":"1"}}]`
+	expJSON := `{"resourceMetrics":[{"resource":{"attributes":[` +
+		`{"key":"k6.test_run_id","value":{"stringValue":"run-42"}},` +
+		`{"key":"service.name","value":{"stringValue":"checkout"}},` +
+		`{"key":"service.version","value":{"stringValue":"` + consts.Version + `"}}]},` +
+		`"scopeMetrics":[{"scope":{"name":"k6","version":"` + consts.Version + `"},"metrics":[` +
+		`{"name":"my_counter","sum":{"dataPoints":[` +
+		`{` + attributes + `,"startTimeUnixNano":"10","timeUnixNano":"10","asDouble":2},` +
+		`{` + attributes + `,"startTimeUnixNano":"30","timeUnixNano":"30","asDouble":1}],` +
+		`"aggregationTemporality":1,"isMonotonic":true}},` +
+		`{"name":"my_trend","unit":"ms","histogram":{"dataPoints":[` +
+		`{` + attributes + `,"startTimeUnixNano":"20","timeUnixNano":"20","count":"1","sum":1.5,` +
+		`"bucketCounts":["1"],"min":1.5,"max":1.5}],"aggregationTemporality":1}}]}]}]}`
+	assert.JSONEq(t, expJSON, messageValue(t, messages[0]))
+
+	o.Config.Format = null.StringFrom("otlp_proto")
+	messages, err = o.batchFromBufferedSamples(containers)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+
+	// a single resource_metrics field spanning the whole payload
+	b := []byte(messageValue(t, messages[0]))
+	num, typ, n := protowire.ConsumeTag(b)
+	require.Equal(t, protowire.Number(1), num)
+	require.Equal(t, protowire.BytesType, typ)
+	_, m := protowire.ConsumeBytes(b[n:])
+	assert.Equal(t, len(b), n+m)
+
+	messages, err = o.batchFromBufferedSamples(nil)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestBatchFromBufferedSamplesPrometheusRemoteWrite(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	counter, err := registry.NewMetric("http_reqs", metrics.Counter)
+	require.NoError(t, err)
+	trend, err := registry.NewMetric("my.custom-trend", metrics.Trend)
+	require.NoError(t, err)
+
+	tags := registry.RootTagSet().WithTagsFromMap(map[string]string{"method": "GET", "expected-response": "true", "empty": ""})
+	counterSample := metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: counter, Tags: tags}, Time: time.UnixMilli(2000), Value: 1}
+	containers := []metrics.SampleContainer{
+		counterSample,
+		metrics.Samples{
+			{TimeSeries: metrics.TimeSeries{Metric: trend, Tags: tags}, Time: time.UnixMilli(1500), Value: 3.5},
+			{TimeSeries: metrics.TimeSeries{Metric: trend, Tags: tags}, Time: time.UnixMilli(1000), Value: 4},
+		},
+	}
+
+	o := Output{router: newTestTopicRouter(t)}
+	o.Config.Format = null.StringFrom("prometheus_remote_write")
+	messages, err := o.batchFromBufferedSamples(containers)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+
+	expLabels := func(name string) []string {
+		return []string{"__name__=" + name, "expected_response=true", "method=GET"}
+	}
+	assert.Equal(t, []testPrometheusSeries{
+		{labels: expLabels("k6_http_reqs_total"), samples: []string{"1@2000"}},
+		{labels: expLabels("k6_my_custom_trend"), samples: []string{"4@1000", "3.5@1500"}},
+	}, decodeTestWriteRequest(t, messageValue(t, messages[0])))
+
+	// counters are sent as running totals across flushes
+	messages, err = o.batchFromBufferedSamples([]metrics.SampleContainer{counterSample})
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, []testPrometheusSeries{
+		{labels: expLabels("k6_http_reqs_total"), samples: []string{"2@2000"}},
+	}, decodeTestWriteRequest(t, messageValue(t, messages[0])))
+}
+
+type testPrometheusSeries struct {
+	labels  []string
+	samples []string
+}
+
+// decodeTestWriteRequest decodes a snappy-compressed remote-write request.
+func decodeTestWriteRequest(t *testing.T, payload string) []testPrometheusSeries {
+	t.Helper()
+	b, err := snappy.Decode(nil, []byte(payload))
+	require.NoError(t, err)
+
+	var series []testPrometheusSeries
+	forEachTestField(t, b, func(_ protowire.Number, ts []byte) {
+		var s testPrometheusSeries
+		forEachTestField(t, ts, func(num protowire.Number, v []byte) {
+			fields := map[protowire.Number]string{}
+			forEachTestField(t, v, func(num protowire.Number, v []byte) { fields[num] = string(v) })
+			if num == 1 {
+				s.labels = append(s.labels, fields[1]+"="+fields[2])
+				return
+			}
+			value := math.Float64frombits(binary.LittleEndian.Uint64([]byte(fields[1])))
+			timestamp, _ := protowire.ConsumeVarint([]byte(fields[2]))
+			s.samples = append(s.samples, fmt.Sprintf("%v@%d", value, timestamp))
+		})
+		series = append(series, s)
+	})
+	return series
+}
+
+// forEachTestField calls fn with the raw value of every field in b, varint and
+// fixed64 values are returned in their wire encoding.
+func forEachTestField(t *testing.T, b []byte, fn func(protowire.Number, []byte)) {
+	t.Helper()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		require.GreaterOrEqual(t, m, 0)
+		value := b[:m]
+		if typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(value)
+		}
+		fn(num, value)
+		b = b[m:]
+	}
+}
+
+func TestFormatSampleInfluxdbLineProtocol(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("my metric", metrics.Trend)
+	require.NoError(t, err)
+
+	samples := metrics.Samples{{
+		TimeSeries: metrics.TimeSeries{
+			Metric: metric,
+			Tags: registry.RootTagSet().WithTagsFromMap(map[string]string{
+				"name":   `a b,c=d\e`,
+				"empty":  "",
+				"vu":     "12",
+				"ok":     "true",
+				"url":    "http://host/?q=\"x\"\n",
+				"ratio":  "0.5",
+				"status": "200",
+			}),
+		},
+		Time:  time.Unix(1, 123456789),
+		Value: 0.25,
+	}}
+
+	o := Output{logger: testutils.NewLogger(t)}
+	o.Config.Format = null.StringFrom("influxdb")
+	o.Config.InfluxDBConfig.TagsAsFields = []string{"vu:int", "ok:bool", "url", "ratio:float"}
+	lines, err := o.formatSamples(samples)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		`my\ metric,name=a\ b\,c\=d\e,status=200 ` +
+			`value=0.25,ok=true,ratio=0.5,url="http://host/?q=\"x\"\n",vu=12i 1123456789`,
+	}, lines)
+
+	o.Config.InfluxDBConfig.TagsAsFields = nil
+	for precision, timestamp := range map[string]string{"us": "1123456", "ms": "1123", "s": "1"} {
+		o.Config.InfluxDBConfig.Precision = null.StringFrom(precision)
+		lines, err = o.formatSamples(samples)
+		require.NoError(t, err)
+		require.Len(t, lines, 1)
+		assert.True(t, strings.HasSuffix(lines[0], " value=0.25 "+timestamp), lines[0])
+	}
+
+	o.Config.InfluxDBConfig.Precision = null.StringFrom("m")
+	_, err = o.formatSamples(samples)
+	assert.EqualError(t, err, "invalid InfluxDB precision (m), it should be one of ns, us, ms or s")
+}
+
+func newTestTopicRouter(t *testing.T, routes ...string) *topicRouter {
+	t.Helper()
+	router, err := newTopicRouter(routes, "my_topic")
+	require.NoError(t, err)
+	return router
+}
+
+func messageValue(t *testing.T, message *sarama.ProducerMessage) string {
+	t.Helper()
+	b, err := message.Value.Encode()
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestBatchFromBufferedSamplesRoutes(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	newSample := func(name string, metricType metrics.MetricType) metrics.Sample {
+		metric, err := registry.NewMetric(name, metricType)
+		require.NoError(t, err)
+		return metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()}}
+	}
+	containers := []metrics.SampleContainer{
+		newSample("http_req_duration", metrics.Trend),
+		newSample("checks", metrics.Rate),
+		newSample("vus", metrics.Gauge),
+		metrics.Samples{newSample("http_reqs", metrics.Counter), newSample("iterations", metrics.Counter)},
+		newSample("data_sent", metrics.Counter),
+	}
+
+	o := Output{router: newTestTopicRouter(t, "http_req_*:k6-http", "checks:k6-checks", "type:counter:k6-counters")}
+	o.Config.Format = null.StringFrom("json")
+	messages, err := o.batchFromBufferedSamples(containers)
+	require.NoError(t, err)
+
+	routed := make(map[string][]string)
+	for _, message := range messages {
+		var e envelope
+		require.NoError(t, json.Unmarshal([]byte(messageValue(t, message)), &e))
+		routed[message.Topic] = append(routed[message.Topic], e.Metric)
+	}
+	assert.Equal(t, map[string][]string{
+		"k6-http":     {"http_req_duration"},
+		"k6-checks":   {"checks"},
+		"my_topic":    {"vus"},
+		"k6-counters": {"http_reqs", "iterations", "data_sent"},
+	}, routed)
+	assert.Equal(t, []string{"my_topic", "k6-http", "k6-checks", "k6-counters"}, o.router.topics())
+
+	// samples of flush formats are grouped in a payload per topic
+	o.Config.Format = null.StringFrom("otlp_json")
+	messages, err = o.batchFromBufferedSamples(containers)
+	require.NoError(t, err)
+	topics := make([]string, len(messages))
+	for i, message := range messages {
+		topics[i] = message.Topic
+	}
+	assert.Equal(t, []string{"k6-http", "k6-checks", "my_topic", "k6-counters"}, topics)
+}
+
+func TestBatchFromBufferedSamplesKeys(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("http_req_duration", metrics.Trend)
+	require.NoError(t, err)
+
+	newSample := func(tags map[string]string) metrics.Sample {
+		return metrics.Sample{TimeSeries: metrics.TimeSeries{
+			Metric: metric,
+			Tags:   registry.RootTagSet().WithTagsFromMap(tags),
+		}}
+	}
+	containers := []metrics.SampleContainer{metrics.Samples{
+		newSample(map[string]string{"scenario": "default", "name": "home", "status": "200"}),
+		newSample(map[string]string{"scenario": "default", "name": "home", "status": "500"}),
+		newSample(map[string]string{"scenario": "default", "name": "home", "status": "200"}),
+	}}
+
+	keysFor := func(key string, keyTags ...string) []string {
+		o := Output{router: newTestTopicRouter(t), keys: newMessageKeys(key, keyTags)}
+		o.Config.Format = null.StringFrom("json")
+		messages, err := o.batchFromBufferedSamples(containers)
+		require.NoError(t, err)
+
+		keys := make([]string, len(messages))
+		for i, message := range messages {
+			if message.Key == nil {
+				continue
+			}
+			b, err := message.Key.Encode()
+			require.NoError(t, err)
+			keys[i] = string(b)
+		}
+		return keys
+	}
+
+	assert.Equal(t, []string{"", "", ""}, keysFor("none"))
+	assert.Equal(t, []string{"http_req_duration", "http_req_duration", "http_req_duration"}, keysFor("metric"))
+	assert.Equal(t, []string{"scenario=default,name=home", "scenario=default,name=home", "scenario=default,name=home"},
+		keysFor("tags", "scenario", "name"))
+
+	series := keysFor("series")
+	assert.Equal(t, series[0], series[2])
+	assert.NotEqual(t, series[0], series[1])
+	assert.Equal(t, seriesHash("http_req_duration", map[string]string{
+		"scenario": "default", "name": "home", "status": "200",
+	}), series[0])
+}
+
+func TestBatchFromBufferedSamplesHeaders(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("http_req_duration", metrics.Trend)
+	require.NoError(t, err)
+	sample := metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()}}
+
+	o := Output{router: newTestTopicRouter(t)}
+	o.Config.Format = null.StringFrom("influxdb")
+	o.Config.TestRunID = null.StringFrom("run-1")
+	messages, err := o.batchFromBufferedSamples([]metrics.SampleContainer{sample})
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Empty(t, messages[0].Headers)
+
+	headersOf := func(message *sarama.ProducerMessage) map[string]string {
+		headers := make(map[string]string)
+		for _, header := range message.Headers {
+			headers[string(header.Key)] = string(header.Value)
+		}
+		return headers
+	}
+
+	o.Config.Headers = null.BoolFrom(true)
+	messages, err = o.batchFromBufferedSamples([]metrics.SampleContainer{sample})
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, map[string]string{
+		"k6-metric":         "http_req_duration",
+		"k6-metric-type":    "trend",
+		"k6-format":         "influxdb",
+		"content-type":      "text/plain",
+		"k6-schema-version": "1",
+		"k6-version":        consts.Version,
+		"k6-test-run-id":    "run-1",
+	}, headersOf(messages[0]))
+
+	// messages with a whole flush don't have the metric headers
+	o.Config.Format = null.StringFrom("otlp_proto")
+	messages, err = o.batchFromBufferedSamples([]metrics.SampleContainer{sample})
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, map[string]string{
+		"k6-format":         "otlp_proto",
+		"content-type":      "application/x-protobuf",
+		"k6-schema-version": "1",
+		"k6-version":        consts.Version,
+		"k6-test-run-id":    "run-1",
+	}, headersOf(messages[0]))
+}
+
+func TestBatchFromBufferedSamplesTimestamp(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("vus", metrics.Gauge)
+	require.NoError(t, err)
+	newSample := func(sec int64) metrics.Sample {
+		return metrics.Sample{
+			TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()},
+			Time:       time.Unix(sec, 0),
+		}
+	}
+	containers := []metrics.SampleContainer{metrics.Samples{newSample(20), newSample(10), newSample(30)}}
+
+	timestampsOf := func(format, mode string) []int64 {
+		o := Output{router: newTestTopicRouter(t)}
+		o.Config.Format = null.StringFrom(format)
+		o.Config.Timestamp = null.StringFrom(mode)
+		messages, err := o.batchFromBufferedSamples(containers)
+		require.NoError(t, err)
+
+		timestamps := make([]int64, len(messages))
+		for i, message := range messages {
+			if !message.Timestamp.IsZero() {
+				timestamps[i] = message.Timestamp.Unix()
+			}
+		}
+		return timestamps
+	}
+
+	assert.Equal(t, []int64{0, 0, 0}, timestampsOf("json", "none"))
+	assert.Equal(t, []int64{20, 10, 30}, timestampsOf("json", "newest"))
+	assert.Equal(t, []int64{20, 10, 30}, timestampsOf("json", "oldest"))
+	assert.Equal(t, []int64{0}, timestampsOf("otlp_json", "none"))
+	assert.Equal(t, []int64{30}, timestampsOf("otlp_json", "newest"))
+	assert.Equal(t, []int64{10}, timestampsOf("otlp_json", "oldest"))
+}
+
+func TestBatchFromBufferedSamplesBatching(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("vus", metrics.Gauge)
+	require.NoError(t, err)
+	newSample := func(scenario string, value float64) metrics.Sample {
+		return metrics.Sample{
+			TimeSeries: metrics.TimeSeries{
+				Metric: metric,
+				Tags:   registry.RootTagSet().WithTagsFromMap(map[string]string{"scenario": scenario}),
+			},
+			Value: value,
+		}
+	}
+	containers := []metrics.SampleContainer{metrics.Samples{
+		newSample("a", 1), newSample("b", 2), newSample("a", 3), newSample("a", 4),
+	}}
+
+	type batchedMessage struct {
+		key, value, count string
+	}
+	batch := func(o *Output) []batchedMessage {
+		messages, err := o.batchFromBufferedSamples(containers)
+		require.NoError(t, err)
+		batched := make([]batchedMessage, len(messages))
+		for i, message := range messages {
+			require.LessOrEqual(t, message.ByteSize(2), o.Config.batchMaxBytes())
+			if message.Key != nil {
+				b, err := message.Key.Encode()
+				require.NoError(t, err)
+				batched[i].key = string(b)
+			}
+			batched[i].value = messageValue(t, message)
+			for _, header := range message.Headers {
+				if string(header.Key) == headerRecordCount {
+					batched[i].count = string(header.Value)
+				}
+			}
+		}
+		return batched
+	}
+
+	o := &Output{router: newTestTopicRouter(t)}
+	o.Config.Format = null.StringFrom("influxdb")
+	o.Config.Batch = null.StringFrom("lines")
+	assert.Equal(t, []batchedMessage{{
+		value: "vus,scenario=a value=1\nvus,scenario=b value=2\nvus,scenario=a value=3\nvus,scenario=a value=4",
+		count: "4",
+	}}, batch(o))
+
+	// samples with different keys are never packed together
+	o.keys = newMessageKeys("tags", []string{"scenario"})
+	assert.Equal(t, []batchedMessage{
+		{key: "scenario=a", value: "vus,scenario=a value=1\nvus,scenario=a value=3\nvus,scenario=a value=4", count: "3"},
+		{key: "scenario=b", value: "vus,scenario=b value=2", count: "1"},
+	}, batch(o))
+
+	// messages are split to stay within batchMaxBytes
+	o.keys = nil
+	o.Config.Format = null.StringFrom("json")
+	o.Config.Batch = null.StringFrom("array")
+	o.Config.BatchMaxBytes = null.IntFrom(300)
+	messages := batch(o)
+	require.Len(t, messages, 2)
+	for _, message := range messages {
+		assert.Equal(t, "2", message.count)
+		var values []envelope
+		require.NoError(t, json.Unmarshal([]byte(message.value), &values))
+		assert.Len(t, values, 2)
+	}
+}
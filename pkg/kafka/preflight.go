@@ -0,0 +1,283 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.k6.io/k6/lib/fsext"
+	"go.k6.io/k6/lib/types"
+	"gopkg.in/guregu/null.v3"
+)
+
+const defaultPreflightTimeout = 10 * time.Second
+
+type preflightConfig struct {
+	Enabled    null.Bool          `json:"enabled" envconfig:"K6_KAFKA_PREFLIGHT_ENABLED"`
+	Timeout    types.NullDuration `json:"timeout" envconfig:"K6_KAFKA_PREFLIGHT_TIMEOUT"`
+	CheckWrite null.Bool          `json:"checkWrite" envconfig:"K6_KAFKA_PREFLIGHT_CHECK_WRITE"`
+	// Principal is the principal whose write permission is checked, like
+	// User:alice. It defaults to the user of the plain and scram mechanisms.
+	Principal null.String `json:"principal" envconfig:"K6_KAFKA_PREFLIGHT_PRINCIPAL"`
+}
+
+func (c preflightConfig) Apply(cfg preflightConfig) preflightConfig {
+	if cfg.Enabled.Valid {
+		c.Enabled = cfg.Enabled
+	}
+	if cfg.Timeout.Valid {
+		c.Timeout = cfg.Timeout
+	}
+	if cfg.CheckWrite.Valid {
+		c.CheckWrite = cfg.CheckWrite
+	}
+	if cfg.Principal.Valid {
+		c.Principal = cfg.Principal
+	}
+	return c
+}
+
+// preflightParseMap parses a map[string]interface{} into a preflightConfig
+func preflightParseMap(m map[string]interface{}) (preflightConfig, error) {
+	c := preflightConfig{}
+	if v, ok := m["enabled"].(bool); ok {
+		c.Enabled = null.BoolFrom(v)
+		delete(m, "enabled")
+	}
+	if v, ok := m["timeout"].(string); ok {
+		if err := c.Timeout.UnmarshalText([]byte(v)); err != nil {
+			return c, err
+		}
+		delete(m, "timeout")
+	}
+	if v, ok := m["checkWrite"].(bool); ok {
+		c.CheckWrite = null.BoolFrom(v)
+		delete(m, "checkWrite")
+	}
+	if v, ok := m["principal"].(string); ok {
+		c.Principal = null.StringFrom(v)
+		delete(m, "principal")
+	}
+	if len(m) > 0 {
+		return c, errors.New("Unknown or unparsed options '" + mapToString(m) + "'")
+	}
+	return c, nil
+}
+
+func (c Config) validatePreflight() error {
+	if !c.Preflight.Enabled.Bool {
+		if c.Preflight.Timeout.Valid || c.Preflight.CheckWrite.Valid || c.Preflight.Principal.Valid {
+			return errors.New("preflight.timeout, preflight.checkWrite and preflight.principal require preflight.enabled")
+		}
+		return nil
+	}
+	if c.Preflight.Timeout.Valid && time.Duration(c.Preflight.Timeout.Duration) <= 0 {
+		return fmt.Errorf("preflight.timeout should be positive but was %s", c.Preflight.Timeout.Duration)
+	}
+	if c.Preflight.Principal.Valid && !c.Preflight.CheckWrite.Bool {
+		return errors.New("preflight.principal requires preflight.checkWrite")
+	}
+	if c.Preflight.CheckWrite.Bool && !c.Preflight.Principal.Valid {
+		switch c.AuthMechanism.String {
+		case "plain", "scram-sha-256", "scram-sha-512":
+		default:
+			return fmt.Errorf("preflight.checkWrite requires preflight.principal with the %s authMechanism",
+				c.AuthMechanism.String)
+		}
+	}
+	return nil
+}
+
+func (c Config) preflightTimeout() time.Duration {
+	if c.Preflight.Timeout.Valid {
+		return time.Duration(c.Preflight.Timeout.Duration)
+	}
+	return defaultPreflightTimeout
+}
+
+// preflightPrincipal returns the principal whose write permission is checked.
+func (c Config) preflightPrincipal(fs fsext.Fs) (string, error) {
+	if c.Preflight.Principal.Valid {
+		return c.Preflight.Principal.String, nil
+	}
+	user, _, err := c.saslCredentials(fs)()
+	if err != nil {
+		return "", err
+	}
+	return "User:" + user, nil
+}
+
+// newClusterAdmin connects a cluster admin to the brokers with the client
+// config of the producer, each request giving up after preflight.timeout, or
+// its default when the preflight check is disabled.
+func newClusterAdmin(config Config, fs fsext.Fs, env map[string]string) (sarama.ClusterAdmin, error) {
+	saramaConfig, err := newSaramaConfig(config, fs, env)
+	if err != nil {
+		return nil, err
+	}
+	timeout := config.preflightTimeout()
+	saramaConfig.Net.DialTimeout = timeout
+	saramaConfig.Net.ReadTimeout = timeout
+	saramaConfig.Net.WriteTimeout = timeout
+	saramaConfig.Admin.Timeout = timeout
+	return sarama.NewClusterAdmin(config.Brokers, saramaConfig)
+}
+
+// preflight checks that the brokers can be reached with the configured
+// credentials, that the topics exist and optionally that they can be written
+// to, so the test fails before any sample is produced into a void.
+func (o *Output) preflight() error {
+	if !o.Config.Preflight.Enabled.Bool || o.newClusterAdmin == nil {
+		return nil
+	}
+	timeout := o.Config.preflightTimeout()
+	done := make(chan error, 1)
+	go func() {
+		done <- o.runPreflight()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("the Kafka preflight check didn't finish within preflight.timeout (%s)", timeout)
+	}
+}
+
+func (o *Output) runPreflight() error {
+	admin, err := o.newClusterAdmin()
+	if err != nil {
+		return fmt.Errorf("couldn't reach the Kafka brokers %s: %w", strings.Join(o.Config.Brokers, ","), err)
+	}
+	defer func() {
+		_ = admin.Close()
+	}()
+
+	topics := o.router.topics()
+	metadata, err := admin.DescribeTopics(topics)
+	if err != nil {
+		return fmt.Errorf("couldn't describe the Kafka topics: %w", err)
+	}
+	if topicsErr := checkTopics(topics, metadata); topicsErr != nil {
+		return topicsErr
+	}
+
+	if o.Config.Preflight.CheckWrite.Bool {
+		principal, principalErr := o.Config.preflightPrincipal(o.fs)
+		if principalErr != nil {
+			return principalErr
+		}
+		for _, topic := range topics {
+			if writeErr := o.checkWritePermission(admin, topic, principal); writeErr != nil {
+				return writeErr
+			}
+		}
+	}
+	o.logger.WithField("topics", topics).Debug("Kafka: Preflight check passed")
+	return nil
+}
+
+// checkTopics returns an error if one of the topics is missing from their
+// metadata or has an error.
+func checkTopics(topics []string, metadata []*sarama.TopicMetadata) error {
+	byName := make(map[string]*sarama.TopicMetadata, len(metadata))
+	for _, m := range metadata {
+		byName[m.Name] = m
+	}
+	for _, topic := range topics {
+		m, ok := byName[topic]
+		if !ok || errors.Is(m.Err, sarama.ErrUnknownTopicOrPartition) {
+			return fmt.Errorf("the %q Kafka topic doesn't exist", topic)
+		}
+		if !errors.Is(m.Err, sarama.ErrNoError) {
+			return fmt.Errorf("couldn't describe the %q Kafka topic: %w", topic, m.Err)
+		}
+	}
+	return nil
+}
+
+// checkWritePermission returns an error if an ACL of the topic denies the
+// principal writing to it. The ACLs can't tell that the principal is allowed,
+// as super users, allow.everyone.if.no.acl.found, authorizers that grant by
+// group or role and the principals of mTLS certificates don't show in them,
+// and listing them needs the Describe permission on the cluster. So when no
+// ACL allows the principal, or the ACLs can't be listed, a warning is logged
+// instead. The hosts of the ACLs aren't checked, and the check passes when the
+// brokers have no authorizer.
+func (o *Output) checkWritePermission(admin sarama.ClusterAdmin, topic, principal string) error {
+	controller, err := admin.Controller()
+	if err != nil {
+		return fmt.Errorf("couldn't reach the Kafka controller: %w", err)
+	}
+	request := &sarama.DescribeAclsRequest{AclFilter: sarama.AclFilter{
+		ResourceType:              sarama.AclResourceTopic,
+		ResourceName:              &topic,
+		ResourcePatternTypeFilter: sarama.AclPatternMatch,
+		Operation:                 sarama.AclOperationAny,
+		PermissionType:            sarama.AclPermissionAny,
+	}}
+	if version, parseErr := sarama.ParseKafkaVersion(o.Config.Version.String); parseErr == nil &&
+		version.IsAtLeast(sarama.V2_0_0_0) {
+		request.Version = 1
+	}
+	logger := o.logger.WithField("topic", topic).WithField("principal", principal)
+	response, err := controller.DescribeAcls(request)
+	if err == nil {
+		err = response.Err
+	}
+	switch {
+	case errors.Is(err, sarama.ErrNoError):
+	case errors.Is(err, sarama.ErrSecurityDisabled):
+		return nil
+	case errors.Is(err, sarama.ErrClusterAuthorizationFailed):
+		logger.WithError(err).Warn("Kafka: Couldn't list the ACLs of the topic to check the write permission")
+		return nil
+	default:
+		return fmt.Errorf("couldn't describe the ACLs of the %q Kafka topic: %w", topic, err)
+	}
+
+	allowed := false
+	for _, resource := range response.ResourceAcls {
+		for _, acl := range resource.Acls {
+			if acl.Principal != principal && acl.Principal != "User:*" {
+				continue
+			}
+			if acl.Operation != sarama.AclOperationWrite && acl.Operation != sarama.AclOperationAll {
+				continue
+			}
+			switch acl.PermissionType {
+			case sarama.AclPermissionDeny:
+				return fmt.Errorf("%s is denied writing to the %q Kafka topic", principal, topic)
+			case sarama.AclPermissionAllow:
+				allowed = true
+			default:
+			}
+		}
+	}
+	if !allowed {
+		logger.Warn("Kafka: No ACL allows the principal to write to the topic, it may still be allowed " +
+			"by a super user, group or default rule")
+	}
+	return nil
+}
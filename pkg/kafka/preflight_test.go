@@ -0,0 +1,173 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/lib/fsext"
+	"go.k6.io/k6/lib/testutils"
+	"go.k6.io/k6/lib/types"
+	"gopkg.in/guregu/null.v3"
+)
+
+func newPreflightTestOutput(t *testing.T, config Config) *Output {
+	t.Helper()
+	router, err := newTopicRouter(config.Routes, config.Topic.String)
+	require.NoError(t, err)
+	fs := fsext.NewMemMapFs()
+	return &Output{
+		logger: testutils.NewLogger(t),
+		Config: config,
+		fs:     fs,
+		router: router,
+		newClusterAdmin: func() (sarama.ClusterAdmin, error) {
+			return newClusterAdmin(config, fs, nil)
+		},
+	}
+}
+
+func newTestACLs(
+	principal string, operation sarama.AclOperation, permission sarama.AclPermissionType,
+) sarama.MockResponse {
+	return sarama.NewMockWrapper(&sarama.DescribeAclsResponse{
+		Err: sarama.ErrNoError,
+		ResourceAcls: []*sarama.ResourceAcls{{
+			Resource: sarama.Resource{
+				ResourceType:        sarama.AclResourceTopic,
+				ResourceName:        "my_",
+				ResourcePatternType: sarama.AclPatternPrefixed,
+			},
+			Acls: []*sarama.Acl{{Principal: principal, Host: "*", Operation: operation, PermissionType: permission}},
+		}},
+	})
+}
+
+func TestPreflight(t *testing.T) {
+	t.Parallel()
+	testCases := map[string]struct {
+		routes []string
+		acls   sarama.MockResponse
+		err    string
+	}{
+		"topics-exist": {
+			routes: []string{"http_*:my_http_topic"},
+		},
+		"missing-routed-topic": {
+			routes: []string{"http_*:other_topic"},
+			err:    `the "other_topic" Kafka topic doesn't exist`,
+		},
+		"write-allowed": {
+			acls: newTestACLs("User:alice", sarama.AclOperationWrite, sarama.AclPermissionAllow),
+		},
+		"write-allowed-to-everyone": {
+			acls: newTestACLs("User:*", sarama.AclOperationAll, sarama.AclPermissionAllow),
+		},
+		"write-denied": {
+			acls: newTestACLs("User:alice", sarama.AclOperationWrite, sarama.AclPermissionDeny),
+			err:  `User:alice is denied writing to the "my_topic" Kafka topic`,
+		},
+		"write-not-allowed": {
+			acls: newTestACLs("User:alice", sarama.AclOperationRead, sarama.AclPermissionAllow),
+		},
+		"acls-not-authorized": {
+			acls: sarama.NewMockWrapper(&sarama.DescribeAclsResponse{Err: sarama.ErrClusterAuthorizationFailed}),
+		},
+		"acls-error": {
+			acls: sarama.NewMockWrapper(&sarama.DescribeAclsResponse{Err: sarama.ErrUnknown}),
+			err: `couldn't describe the ACLs of the "my_topic" Kafka topic: ` +
+				`kafka server: Unexpected (unknown?) server error`,
+		},
+		"security-disabled": {
+			acls: sarama.NewMockWrapper(&sarama.DescribeAclsResponse{Err: sarama.ErrSecurityDisabled}),
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			broker := sarama.NewMockBroker(t, 1)
+			defer broker.Close()
+			handlers := map[string]sarama.MockResponse{
+				"MetadataRequest": sarama.NewMockMetadataResponse(t).
+					SetController(broker.BrokerID()).
+					SetBroker(broker.Addr(), broker.BrokerID()).
+					SetLeader("my_topic", 0, broker.BrokerID()).
+					SetLeader("my_http_topic", 0, broker.BrokerID()),
+			}
+			config := NewConfig()
+			config.Brokers = []string{broker.Addr()}
+			config.Topic = null.StringFrom("my_topic")
+			config.Routes = testCase.routes
+			config.Preflight.Enabled = null.BoolFrom(true)
+			if testCase.acls != nil {
+				handlers["DescribeAclsRequest"] = testCase.acls
+				config.Preflight.CheckWrite = null.BoolFrom(true)
+				config.Preflight.Principal = null.StringFrom("User:alice")
+			}
+			broker.SetHandlerByMap(handlers)
+
+			err := newPreflightTestOutput(t, config).preflight()
+			if testCase.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, testCase.err)
+			}
+		})
+	}
+}
+
+func TestPreflightUnreachableBrokers(t *testing.T) {
+	t.Parallel()
+	broker := sarama.NewMockBroker(t, 1)
+	addr := broker.Addr()
+	broker.Close()
+
+	config := NewConfig()
+	config.Brokers = []string{addr}
+	config.Topic = null.StringFrom("my_topic")
+	config.Preflight.Enabled = null.BoolFrom(true)
+	err := newPreflightTestOutput(t, config).preflight()
+	require.ErrorIs(t, err, sarama.ErrOutOfBrokers)
+	assert.Contains(t, err.Error(), "couldn't reach the Kafka brokers "+addr)
+}
+
+func TestPreflightTimeout(t *testing.T) {
+	t.Parallel()
+	config := NewConfig()
+	config.Topic = null.StringFrom("my_topic")
+	config.Preflight.Enabled = null.BoolFrom(true)
+	config.Preflight.Timeout = types.NullDurationFrom(50 * time.Millisecond)
+	o := newPreflightTestOutput(t, config)
+	unblock := make(chan struct{})
+	defer close(unblock)
+	o.newClusterAdmin = func() (sarama.ClusterAdmin, error) {
+		<-unblock
+		return nil, sarama.ErrOutOfBrokers
+	}
+
+	assert.EqualError(t, o.preflight(), "the Kafka preflight check didn't finish within preflight.timeout (50ms)")
+}
@@ -0,0 +1,333 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"go.k6.io/k6/metrics"
+	"gopkg.in/guregu/null.v3"
+)
+
+// The overflow policies of a full queue.
+const (
+	queueBlock          = "block"
+	queueDropOldest     = "drop-oldest"
+	queueDropNewest     = "drop-newest"
+	queueDropByPriority = "drop-by-metric-priority"
+)
+
+const (
+	defaultQueueMaxMessages = 100000
+	defaultQueueMaxBytes    = 64 << 20
+)
+
+type queueConfig struct {
+	MaxMessages null.Int    `json:"maxMessages" envconfig:"K6_KAFKA_QUEUE_MAX_MESSAGES"`
+	MaxBytes    null.Int    `json:"maxBytes" envconfig:"K6_KAFKA_QUEUE_MAX_BYTES"`
+	Overflow    null.String `json:"overflow" envconfig:"K6_KAFKA_QUEUE_OVERFLOW"`
+	Priorities  []string    `json:"priorities,omitempty" envconfig:"K6_KAFKA_QUEUE_PRIORITIES"`
+}
+
+func (c queueConfig) Apply(cfg queueConfig) queueConfig {
+	if cfg.MaxMessages.Valid {
+		c.MaxMessages = cfg.MaxMessages
+	}
+	if cfg.MaxBytes.Valid {
+		c.MaxBytes = cfg.MaxBytes
+	}
+	if cfg.Overflow.Valid {
+		c.Overflow = cfg.Overflow
+	}
+	if len(cfg.Priorities) > 0 {
+		c.Priorities = cfg.Priorities
+	}
+	return c
+}
+
+// queueParseMap parses a map[string]interface{} into a queueConfig
+func queueParseMap(m map[string]interface{}) (queueConfig, error) {
+	c := queueConfig{}
+	if v, ok := m["maxMessages"].(int64); ok {
+		c.MaxMessages = null.IntFrom(v)
+		delete(m, "maxMessages")
+	}
+	if v, ok := m["maxBytes"].(int64); ok {
+		c.MaxBytes = null.IntFrom(v)
+		delete(m, "maxBytes")
+	}
+	if v, ok := m["overflow"].(string); ok {
+		c.Overflow = null.StringFrom(v)
+		delete(m, "overflow")
+	}
+	if v, ok := m["priorities"].(string); ok {
+		c.Priorities = []string{v}
+		delete(m, "priorities")
+	}
+	if v, ok := m["priorities"].([]interface{}); ok {
+		c.Priorities = interfaceSliceToStringSlice(v)
+		delete(m, "priorities")
+	}
+	if len(m) > 0 {
+		return c, errors.New("Unknown or unparsed options '" + mapToString(m) + "'")
+	}
+	return c, nil
+}
+
+func (c Config) validateQueue() error {
+	if c.Transactional.Bool && (c.Queue.MaxMessages.Valid || c.Queue.MaxBytes.Valid || c.Queue.Overflow.Valid) {
+		return errors.New("the queue options can't be used with transactional, transactions are produced without the queue")
+	}
+	if c.Queue.MaxMessages.Valid && c.Queue.MaxMessages.Int64 <= 0 {
+		return fmt.Errorf("queue.maxMessages should be positive but was %d", c.Queue.MaxMessages.Int64)
+	}
+	if c.Queue.MaxBytes.Valid && c.Queue.MaxBytes.Int64 <= 0 {
+		return fmt.Errorf("queue.maxBytes should be positive but was %d", c.Queue.MaxBytes.Int64)
+	}
+	switch c.Queue.Overflow.String {
+	case "", queueBlock, queueDropOldest, queueDropNewest:
+		if len(c.Queue.Priorities) > 0 {
+			return fmt.Errorf("queue.priorities requires queue.overflow=%s", queueDropByPriority)
+		}
+	case queueDropByPriority:
+		if len(c.Queue.Priorities) == 0 {
+			return fmt.Errorf("queue.overflow=%s requires queue.priorities", queueDropByPriority)
+		}
+	default:
+		return fmt.Errorf("invalid queue.overflow (%s), it should be one of %s, %s, %s or %s", c.Queue.Overflow.String,
+			queueBlock, queueDropOldest, queueDropNewest, queueDropByPriority)
+	}
+	return nil
+}
+
+type queuedMessage struct {
+	message  *sarama.ProducerMessage
+	size     int64
+	priority int
+}
+
+// messageQueue is the bounded queue between the flushes and the producer, so a
+// slow producer doesn't stall the flushes. What happens when it's full depends
+// on the overflow policy.
+type messageQueue struct {
+	maxMessages int
+	maxBytes    int64
+	overflow    string
+	// priorities are the priorities of the metrics, the higher the later their
+	// messages are dropped, nil unless the overflow policy uses them.
+	priorities map[string]int
+	// onDrop is called with every dropped message.
+	onDrop func(*sarama.ProducerMessage)
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	messages []queuedMessage
+	bytes    int64
+	closed   bool
+	dropped  int64
+}
+
+func newMessageQueue(c queueConfig) *messageQueue {
+	q := &messageQueue{
+		maxMessages: defaultQueueMaxMessages,
+		maxBytes:    defaultQueueMaxBytes,
+		overflow:    queueBlock,
+	}
+	if c.MaxMessages.Valid {
+		q.maxMessages = int(c.MaxMessages.Int64)
+	}
+	if c.MaxBytes.Valid {
+		q.maxBytes = c.MaxBytes.Int64
+	}
+	if c.Overflow.Valid {
+		q.overflow = c.Overflow.String
+	}
+	if q.overflow == queueDropByPriority {
+		// the first metric has the highest priority, the metrics that aren't
+		// listed the lowest
+		q.priorities = make(map[string]int, len(c.Priorities))
+		for i, name := range c.Priorities {
+			q.priorities[name] = len(c.Priorities) - i
+		}
+	}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// priority returns the priority of a message with the samples, the highest
+// priority of their metrics. It's kept as the Metadata of the message.
+func (q *messageQueue) priority(samples []metrics.Sample) interface{} {
+	if q == nil || q.priorities == nil {
+		return nil
+	}
+	priority := 0
+	for _, sample := range samples {
+		if p := q.priorities[sample.Metric.Name]; p > priority {
+			priority = p
+		}
+	}
+	return priority
+}
+
+// fits returns true if a message of the size can be queued without going over
+// the limits. A message larger than maxBytes fits an empty queue, so it isn't
+// blocked forever.
+func (q *messageQueue) fits(size int64) bool {
+	if len(q.messages) == 0 {
+		return true
+	}
+	return len(q.messages) < q.maxMessages && q.bytes+size <= q.maxBytes
+}
+
+// push queues the message, applying the overflow policy when the queue is
+// full. With the block policy, it waits until there's room, and with the
+// drop-by-metric-priority policy it drops the oldest of the messages with the
+// lowest priority, or the new message if its priority is lower than theirs.
+func (q *messageQueue) push(message *sarama.ProducerMessage) {
+	queued := queuedMessage{message: message, size: int64(message.ByteSize(2))}
+	if priority, ok := message.Metadata.(int); ok {
+		queued.priority = priority
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for !q.closed && !q.fits(queued.size) {
+		switch q.overflow {
+		case queueDropNewest:
+			q.drop(message)
+			return
+		case queueDropOldest:
+			q.drop(q.remove(0))
+		case queueDropByPriority:
+			i := q.lowestPriority()
+			if q.messages[i].priority > queued.priority {
+				q.drop(message)
+				return
+			}
+			q.drop(q.remove(i))
+		default:
+			q.notFull.Wait()
+		}
+	}
+	q.messages = append(q.messages, queued)
+	q.bytes += queued.size
+	q.notEmpty.Signal()
+}
+
+// lowestPriority returns the index of the oldest message with the lowest
+// priority.
+func (q *messageQueue) lowestPriority() int {
+	lowest := 0
+	for i, queued := range q.messages {
+		if queued.priority < q.messages[lowest].priority {
+			lowest = i
+		}
+	}
+	return lowest
+}
+
+func (q *messageQueue) remove(i int) *sarama.ProducerMessage {
+	removed := q.messages[i]
+	q.bytes -= removed.size
+	q.messages = append(q.messages[:i], q.messages[i+1:]...)
+	return removed.message
+}
+
+func (q *messageQueue) drop(message *sarama.ProducerMessage) {
+	q.dropped++
+	if q.onDrop != nil {
+		q.onDrop(message)
+	}
+}
+
+// pop waits for a message and removes it from the queue. It returns false once
+// the queue is closed and empty.
+func (q *messageQueue) pop() (*sarama.ProducerMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.messages) == 0 {
+		if q.closed {
+			return nil, false
+		}
+		q.notEmpty.Wait()
+	}
+	queued := q.messages[0]
+	q.messages[0] = queuedMessage{}
+	q.messages = q.messages[1:]
+	q.bytes -= queued.size
+	q.notFull.Broadcast()
+	return queued.message, true
+}
+
+// close stops pushes from blocking, and lets pop return false once the queued
+// messages are all popped.
+func (q *messageQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// droppedMessages returns how many messages were dropped because the queue was
+// full.
+func (q *messageQueue) droppedMessages() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+// startSending starts sending the queued messages to the producer.
+func (o *Output) startSending() {
+	o.queue = newMessageQueue(o.Config.Queue)
+	o.queue.onDrop = o.stats.dropped
+	o.sendWg.Add(1)
+	go func() {
+		defer o.sendWg.Done()
+		for {
+			message, ok := o.queue.pop()
+			if !ok {
+				return
+			}
+			o.Producer.Input() <- message
+			o.stats.produced(message)
+		}
+	}()
+}
+
+// stopSending waits for the queued messages to be sent to the producer, and
+// reports how many were dropped.
+func (o *Output) stopSending() {
+	o.queue.close()
+	o.sendWg.Wait()
+	if dropped := o.queue.droppedMessages(); dropped > 0 {
+		o.logger.WithField("messages", dropped).WithField("overflow", o.queue.overflow).
+			Warn("Kafka: Messages were dropped because the queue was full")
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/lib/testutils"
+	"go.k6.io/k6/metrics"
+	"gopkg.in/guregu/null.v3"
+)
+
+func newQueueTestMessage(value string, priority interface{}) *sarama.ProducerMessage {
+	return &sarama.ProducerMessage{Topic: "my_topic", Value: sarama.StringEncoder(value), Metadata: priority}
+}
+
+// popAll closes the queue and returns the values of the queued messages.
+func popAll(q *messageQueue) []string {
+	q.close()
+	var values []string
+	for {
+		message, ok := q.pop()
+		if !ok {
+			return values
+		}
+		value, _ := message.Value.Encode()
+		values = append(values, string(value))
+	}
+}
+
+func TestMessageQueueOverflow(t *testing.T) {
+	t.Parallel()
+	testCases := map[string]struct {
+		config queueConfig
+		values []string
+	}{
+		"drop-oldest": {
+			config: queueConfig{MaxMessages: null.IntFrom(3), Overflow: null.StringFrom(queueDropOldest)},
+			values: []string{"c", "d", "e"},
+		},
+		"drop-newest": {
+			config: queueConfig{MaxMessages: null.IntFrom(3), Overflow: null.StringFrom(queueDropNewest)},
+			values: []string{"a", "b", "c"},
+		},
+		"drop-by-metric-priority": {
+			config: queueConfig{
+				MaxMessages: null.IntFrom(3),
+				Overflow:    null.StringFrom(queueDropByPriority),
+				Priorities:  []string{"checks"},
+			},
+			// a and c have the highest priority, and the oldest of the lower
+			// priority messages are dropped first
+			values: []string{"a", "c", "e"},
+		},
+	}
+	priorities := []interface{}{1, 0, 1, 0, 0}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			q := newMessageQueue(testCase.config)
+			for i, value := range []string{"a", "b", "c", "d", "e"} {
+				q.push(newQueueTestMessage(value, priorities[i]))
+			}
+			assert.Equal(t, int64(2), q.droppedMessages())
+			assert.Equal(t, testCase.values, popAll(q))
+		})
+	}
+}
+
+func TestMessageQueueMaxBytes(t *testing.T) {
+	t.Parallel()
+	size := int64(newQueueTestMessage("a", nil).ByteSize(2))
+	q := newMessageQueue(queueConfig{MaxBytes: null.IntFrom(2 * size), Overflow: null.StringFrom(queueDropNewest)})
+	for _, value := range []string{"a", "b", "c"} {
+		q.push(newQueueTestMessage(value, nil))
+	}
+	assert.Equal(t, int64(1), q.droppedMessages())
+	assert.Equal(t, []string{"a", "b"}, popAll(q))
+
+	// a message larger than maxBytes still goes through an empty queue
+	q = newMessageQueue(queueConfig{MaxBytes: null.IntFrom(1), Overflow: null.StringFrom(queueDropNewest)})
+	q.push(newQueueTestMessage("large", nil))
+	assert.Equal(t, []string{"large"}, popAll(q))
+}
+
+func TestMessageQueueBlock(t *testing.T) {
+	t.Parallel()
+	q := newMessageQueue(queueConfig{MaxMessages: null.IntFrom(1)})
+	q.push(newQueueTestMessage("a", nil))
+
+	pushed := make(chan struct{})
+	go func() {
+		q.push(newQueueTestMessage("b", nil))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push didn't block on a full queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	message, ok := q.pop()
+	require.True(t, ok)
+	assert.Equal(t, sarama.StringEncoder("a"), message.Value)
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push is still blocked after a pop")
+	}
+	assert.Equal(t, int64(0), q.droppedMessages())
+	assert.Equal(t, []string{"b"}, popAll(q))
+}
+
+// stalledProducer is a producer whose input is never read, like when the
+// brokers are too slow.
+type stalledProducer struct {
+	sarama.AsyncProducer
+	input chan *sarama.ProducerMessage
+}
+
+func (p *stalledProducer) Input() chan<- *sarama.ProducerMessage { return p.input }
+func (p *stalledProducer) IsTransactional() bool                 { return false }
+
+func TestFlushMetricsDoesNotBlockOnStalledProducer(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	checks, err := registry.NewMetric("checks", metrics.Rate)
+	require.NoError(t, err)
+	iterations, err := registry.NewMetric("iterations", metrics.Counter)
+	require.NoError(t, err)
+
+	config := NewConfig()
+	config.Topic = null.StringFrom("my_topic")
+	config.Queue = queueConfig{
+		MaxMessages: null.IntFrom(2),
+		Overflow:    null.StringFrom(queueDropByPriority),
+		Priorities:  []string{"checks"},
+	}
+	o := &Output{
+		Producer: &stalledProducer{input: make(chan *sarama.ProducerMessage)},
+		logger:   testutils.NewLogger(t),
+		Config:   config,
+		router:   newTestTopicRouter(t),
+		keys:     newMessageKeys("", nil),
+	}
+	o.queue = newMessageQueue(config.Queue)
+
+	var samples []metrics.SampleContainer
+	for _, metric := range []*metrics.Metric{checks, iterations, iterations, checks, iterations} {
+		samples = append(samples, metrics.Sample{
+			TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()},
+			Value:      1,
+		})
+	}
+	o.SampleBuffer.AddMetricSamples(samples)
+
+	flushed := make(chan struct{})
+	go func() {
+		o.flushMetrics()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flushMetrics blocked on the stalled producer")
+	}
+	assert.Equal(t, int64(3), o.queue.droppedMessages())
+
+	o.queue.close()
+	for _, name := range []string{"checks", "checks"} {
+		message, ok := o.queue.pop()
+		require.True(t, ok)
+		value, err := message.Value.Encode()
+		require.NoError(t, err)
+		assert.Contains(t, string(value), `"metric":"`+name+`"`)
+	}
+}
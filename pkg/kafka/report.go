@@ -0,0 +1,203 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"go.k6.io/k6/lib/fsext"
+)
+
+// deliveryCounts are the messages, and their bytes, at every stage of the
+// delivery. The bytes are the sizes of the keys and values.
+type deliveryCounts struct {
+	Produced      int64 `json:"produced"`
+	ProducedBytes int64 `json:"producedBytes"`
+	Acked         int64 `json:"acked"`
+	AckedBytes    int64 `json:"ackedBytes"`
+	Failed        int64 `json:"failed"`
+	FailedBytes   int64 `json:"failedBytes"`
+	Dropped       int64 `json:"dropped"`
+	DroppedBytes  int64 `json:"droppedBytes"`
+	// Replayed are the failed messages that were delivered from the spool.
+	Replayed      int64 `json:"replayed"`
+	ReplayedBytes int64 `json:"replayedBytes"`
+	// ReplayedPrevious are the messages left in the spool by previous runs
+	// that were delivered. They don't make up for the failures of this run.
+	ReplayedPrevious      int64 `json:"replayedPrevious"`
+	ReplayedPreviousBytes int64 `json:"replayedPreviousBytes"`
+}
+
+func (c *deliveryCounts) add(counts deliveryCounts) {
+	c.Produced += counts.Produced
+	c.ProducedBytes += counts.ProducedBytes
+	c.Acked += counts.Acked
+	c.AckedBytes += counts.AckedBytes
+	c.Failed += counts.Failed
+	c.FailedBytes += counts.FailedBytes
+	c.Dropped += counts.Dropped
+	c.DroppedBytes += counts.DroppedBytes
+	c.Replayed += counts.Replayed
+	c.ReplayedBytes += counts.ReplayedBytes
+	c.ReplayedPrevious += counts.ReplayedPrevious
+	c.ReplayedPreviousBytes += counts.ReplayedPreviousBytes
+}
+
+// deliveryReport is the summary of the delivery of a test run.
+type deliveryReport struct {
+	// Complete is true if every message of the run was delivered, directly or
+	// from the spool.
+	Complete bool                       `json:"complete"`
+	Total    deliveryCounts             `json:"total"`
+	Topics   map[string]*deliveryCounts `json:"topics"`
+}
+
+// deliveryStats counts the messages by topic as they're produced, acknowledged,
+// failed or dropped. A nil deliveryStats counts nothing.
+type deliveryStats struct {
+	mu     sync.Mutex
+	topics map[string]*deliveryCounts
+}
+
+func newDeliveryStats() *deliveryStats {
+	return &deliveryStats{topics: make(map[string]*deliveryCounts)}
+}
+
+func (s *deliveryStats) count(message *sarama.ProducerMessage, count func(c *deliveryCounts, size int64)) {
+	if s == nil {
+		return
+	}
+	var size int64
+	if message.Key != nil {
+		size += int64(message.Key.Length())
+	}
+	if message.Value != nil {
+		size += int64(message.Value.Length())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts, ok := s.topics[message.Topic]
+	if !ok {
+		counts = &deliveryCounts{}
+		s.topics[message.Topic] = counts
+	}
+	count(counts, size)
+}
+
+func (s *deliveryStats) produced(message *sarama.ProducerMessage) {
+	s.count(message, func(c *deliveryCounts, size int64) {
+		c.Produced++
+		c.ProducedBytes += size
+	})
+}
+
+func (s *deliveryStats) acked(message *sarama.ProducerMessage) {
+	s.count(message, func(c *deliveryCounts, size int64) {
+		c.Acked++
+		c.AckedBytes += size
+	})
+}
+
+func (s *deliveryStats) failed(message *sarama.ProducerMessage) {
+	s.count(message, func(c *deliveryCounts, size int64) {
+		c.Failed++
+		c.FailedBytes += size
+	})
+}
+
+func (s *deliveryStats) dropped(message *sarama.ProducerMessage) {
+	s.count(message, func(c *deliveryCounts, size int64) {
+		c.Dropped++
+		c.DroppedBytes += size
+	})
+}
+
+func (s *deliveryStats) replayed(message *sarama.ProducerMessage) {
+	s.count(message, func(c *deliveryCounts, size int64) {
+		c.Replayed++
+		c.ReplayedBytes += size
+	})
+}
+
+func (s *deliveryStats) replayedPrevious(message *sarama.ProducerMessage) {
+	s.count(message, func(c *deliveryCounts, size int64) {
+		c.ReplayedPrevious++
+		c.ReplayedPreviousBytes += size
+	})
+}
+
+// report returns the delivery report of the messages counted so far.
+func (s *deliveryStats) report() deliveryReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := deliveryReport{Topics: make(map[string]*deliveryCounts, len(s.topics))}
+	for topic, counts := range s.topics {
+		topicCounts := *counts
+		report.Topics[topic] = &topicCounts
+		report.Total.add(topicCounts)
+	}
+	report.Complete = report.Total.Dropped == 0 &&
+		report.Total.Acked+report.Total.Replayed == report.Total.Produced
+	return report
+}
+
+// reportDelivery logs the delivery report, and writes it to deliveryReport
+// when it's set.
+func (o *Output) reportDelivery() {
+	report := o.stats.report()
+	logger := o.logger.
+		WithField("produced", report.Total.Produced).
+		WithField("acked", report.Total.Acked).
+		WithField("failed", report.Total.Failed).
+		WithField("dropped", report.Total.Dropped)
+	if o.spool != nil {
+		logger = logger.WithField("replayed", report.Total.Replayed).
+			WithField("replayedPrevious", report.Total.ReplayedPrevious)
+	}
+	if report.Complete {
+		logger.Info("Kafka: All the messages were delivered")
+	} else {
+		logger.Warn("Kafka: Not all the messages were delivered")
+	}
+
+	if !o.Config.DeliveryReport.Valid {
+		return
+	}
+	if err := writeDeliveryReport(o.fs, o.Config.DeliveryReport.String, report); err != nil {
+		o.logger.WithError(err).Error("Kafka: Failed to write the delivery report")
+	}
+}
+
+func writeDeliveryReport(fs fsext.Fs, path string, report deliveryReport) error {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fsext.WriteFile(fs, path, append(b, '\n'), 0o644); err != nil { //nolint:gosec // the report isn't secret
+		return fmt.Errorf("couldn't write %s: %w", path, err)
+	}
+	return nil
+}
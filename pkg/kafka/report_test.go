@@ -0,0 +1,250 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/lib/fsext"
+	"go.k6.io/k6/lib/testutils"
+	"go.k6.io/k6/metrics"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestDeliveryStatsReport(t *testing.T) {
+	t.Parallel()
+	message := func(topic, value string) *sarama.ProducerMessage {
+		return &sarama.ProducerMessage{Topic: topic, Key: sarama.StringEncoder("k"), Value: sarama.StringEncoder(value)}
+	}
+
+	stats := newDeliveryStats()
+	stats.produced(message("a", "1234"))
+	stats.acked(message("a", "1234"))
+	stats.produced(message("b", "12"))
+	stats.failed(message("b", "12"))
+	report := stats.report()
+	assert.False(t, report.Complete)
+	assert.Equal(t, deliveryCounts{Produced: 1, ProducedBytes: 5, Acked: 1, AckedBytes: 5}, *report.Topics["a"])
+	assert.Equal(t, deliveryCounts{Produced: 1, ProducedBytes: 3, Failed: 1, FailedBytes: 3}, *report.Topics["b"])
+	assert.Equal(t, deliveryCounts{
+		Produced: 2, ProducedBytes: 8, Acked: 1, AckedBytes: 5, Failed: 1, FailedBytes: 3,
+	}, report.Total)
+
+	// a message left in the spool by a previous run doesn't make up for it
+	stats.replayedPrevious(message("b", "12"))
+	assert.False(t, stats.report().Complete)
+
+	// the failed message was delivered from the spool
+	stats.replayed(message("b", "12"))
+	assert.True(t, stats.report().Complete)
+
+	stats.dropped(message("a", "1"))
+	assert.False(t, stats.report().Complete)
+}
+
+func TestStopWritesDeliveryReport(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("my_metric", metrics.Counter)
+	require.NoError(t, err)
+	sample := metrics.Sample{
+		TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()},
+		Value:      1,
+	}
+
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Producer.Return.Successes = true
+	producer := mocks.NewAsyncProducer(t, saramaConfig)
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndFail(sarama.ErrNotEnoughReplicas)
+
+	fs := fsext.NewMemMapFs()
+	config := NewConfig()
+	config.Topic = null.StringFrom("my_topic")
+	config.DeliveryReport = null.StringFrom("/results/kafka-delivery.json")
+	o := &Output{
+		Producer: producer,
+		logger:   testutils.NewLogger(t),
+		Config:   config,
+		fs:       fs,
+		router:   newTestTopicRouter(t),
+		keys:     newMessageKeys("", nil),
+	}
+	require.NoError(t, o.Start())
+	o.AddMetricSamples([]metrics.SampleContainer{sample, sample, sample})
+	require.NoError(t, o.Stop())
+
+	b, err := fsext.ReadFile(fs, "/results/kafka-delivery.json")
+	require.NoError(t, err)
+	var report deliveryReport
+	require.NoError(t, json.Unmarshal(b, &report))
+	assert.False(t, report.Complete)
+	assert.Equal(t, int64(3), report.Total.Produced)
+	assert.Equal(t, int64(2), report.Total.Acked)
+	assert.Equal(t, int64(1), report.Total.Failed)
+	assert.Equal(t, int64(0), report.Total.Dropped)
+	require.Contains(t, report.Topics, "my_topic")
+	assert.Equal(t, report.Total, *report.Topics["my_topic"])
+}
+
+func TestReportIgnoresPreviousRunReplays(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("my_metric", metrics.Counter)
+	require.NoError(t, err)
+
+	// a previous run left two messages in the spool
+	fs := fsext.NewMemMapFs()
+	config := NewConfig()
+	config.Topic = null.StringFrom("my_topic")
+	config.LogError = null.BoolFrom(false)
+	config.Spool = spoolConfig{Dir: null.StringFrom("/spool"), Drain: null.BoolFrom(false)}
+	s, err := openSpool(fs, config.Spool)
+	require.NoError(t, err)
+	require.NoError(t, s.append(newSpoolTestMessages(0, 2)...))
+	require.NoError(t, s.close())
+	s, err = openSpool(fs, config.Spool)
+	require.NoError(t, err)
+
+	producer := mocks.NewAsyncProducer(t, nil)
+	producer.ExpectInputAndFail(sarama.ErrOutOfBrokers)
+	replayProducer := mocks.NewSyncProducer(t, nil)
+	replayProducer.ExpectSendMessageAndSucceed()
+	replayProducer.ExpectSendMessageAndSucceed()
+	o := &Output{
+		Producer:       producer,
+		logger:         testutils.NewLogger(t),
+		Config:         config,
+		fs:             fs,
+		router:         newTestTopicRouter(t),
+		keys:           newMessageKeys("", nil),
+		spool:          s,
+		replayProducer: replayProducer,
+	}
+	require.NoError(t, o.Start())
+	// the replay at Start delivers the messages of the previous run
+	require.Eventually(t, func() bool { return s.pending() == 0 }, 5*time.Second, 10*time.Millisecond)
+	o.AddMetricSamples([]metrics.SampleContainer{metrics.Sample{
+		TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()},
+		Value:      1,
+	}})
+	require.NoError(t, o.Stop())
+
+	report := o.stats.report()
+	assert.False(t, report.Complete)
+	assert.Equal(t, int64(1), report.Total.Produced)
+	assert.Equal(t, int64(1), report.Total.Failed)
+	assert.Equal(t, int64(0), report.Total.Replayed)
+	assert.Equal(t, int64(2), report.Total.ReplayedPrevious)
+	assert.Equal(t, 1, s.pending())
+}
+
+// ackingTxnProducer is a transactional producer whose messages are all acked
+// by the brokers, whether their transaction is committed or not.
+type ackingTxnProducer struct {
+	*txnProducer
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+}
+
+func (p *ackingTxnProducer) Input() chan<- *sarama.ProducerMessage     { return p.successes }
+func (p *ackingTxnProducer) Successes() <-chan *sarama.ProducerMessage { return p.successes }
+func (p *ackingTxnProducer) Errors() <-chan *sarama.ProducerError      { return p.errors }
+func (p *ackingTxnProducer) AsyncClose()                               { close(p.successes); close(p.errors) }
+
+// downSyncProducer is a replay producer that can't reach the brokers.
+type downSyncProducer struct {
+	sarama.SyncProducer
+}
+
+func (downSyncProducer) SendMessages([]*sarama.ProducerMessage) error { return sarama.ErrOutOfBrokers }
+func (downSyncProducer) Close() error                                 { return nil }
+
+func TestReportAbortedTransaction(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("my_metric", metrics.Counter)
+	require.NoError(t, err)
+	sample := metrics.Sample{
+		TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()},
+		Value:      1,
+	}
+
+	fs := fsext.NewMemMapFs()
+	config := NewConfig()
+	config.Topic = null.StringFrom("my_topic")
+	config.Spool = spoolConfig{Dir: null.StringFrom("/spool"), Drain: null.BoolFrom(false)}
+	config.StopTest.ConsecutiveFailures = null.IntFrom(2)
+	s, err := openSpool(fs, config.Spool)
+	require.NoError(t, err)
+
+	o := &Output{
+		Producer: &ackingTxnProducer{
+			txnProducer: &txnProducer{commitErr: sarama.ErrOutOfOrderSequenceNumber},
+			successes:   make(chan *sarama.ProducerMessage, 10),
+			errors:      make(chan *sarama.ProducerError),
+		},
+		logger:         testutils.NewLogger(t),
+		Config:         config,
+		fs:             fs,
+		router:         newTestTopicRouter(t),
+		keys:           newMessageKeys("", nil),
+		spool:          s,
+		replayProducer: downSyncProducer{},
+	}
+	stopped := make(chan error, 1)
+	o.SetTestRunStopCallback(func(err error) { stopped <- err })
+
+	require.NoError(t, o.Start())
+	o.AddMetricSamples([]metrics.SampleContainer{sample, sample})
+	require.NoError(t, o.Stop())
+
+	// the acks of the aborted transaction don't count
+	report := o.stats.report()
+	assert.False(t, report.Complete)
+	assert.Equal(t, int64(2), report.Total.Produced)
+	assert.Equal(t, int64(0), report.Total.Acked)
+	assert.Equal(t, int64(2), report.Total.Failed)
+	assert.Equal(t, 2, s.pending())
+	select {
+	case err := <-stopped:
+		require.ErrorIs(t, err, sarama.ErrOutOfOrderSequenceNumber)
+	default:
+		t.Fatal("the test run wasn't stopped")
+	}
+
+	// the run is complete once the spooled messages are delivered
+	replayProducer := mocks.NewSyncProducer(t, nil)
+	replayProducer.ExpectSendMessageAndSucceed()
+	replayProducer.ExpectSendMessageAndSucceed()
+	o.replayProducer = replayProducer
+	require.NoError(t, o.replaySpool())
+	report = o.stats.report()
+	assert.True(t, report.Complete)
+	assert.Equal(t, int64(2), report.Total.Replayed)
+}
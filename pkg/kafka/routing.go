@@ -0,0 +1,124 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"go.k6.io/k6/metrics"
+)
+
+// topicRouter picks the topic every sample is sent to, based on the routes
+// config, falling back to the configured topic.
+type topicRouter struct {
+	routes       []route
+	defaultTopic string
+	cache        map[*metrics.Metric]string
+}
+
+// route sends the metrics with a name matching the glob pattern, or of the
+// given type if isType is set, to topic.
+type route struct {
+	pattern    string
+	isType     bool
+	metricType metrics.MetricType
+	topic      string
+}
+
+// parseRoute parses a route in the "<metric name glob>:<topic>" or
+// "type:<metric type>:<topic>" forms.
+func parseRoute(s string) (route, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return route{}, fmt.Errorf(
+			"invalid route (%s), it should be <metric name glob>:<topic> or type:<metric type>:<topic>", s)
+	}
+	r := route{pattern: s[:i], topic: s[i+1:]}
+
+	if strings.HasPrefix(r.pattern, "type:") {
+		r.isType = true
+		if err := r.metricType.UnmarshalText([]byte(strings.TrimPrefix(r.pattern, "type:"))); err != nil {
+			return route{}, fmt.Errorf("invalid route (%s): %w", s, err)
+		}
+		return r, nil
+	}
+
+	if _, err := path.Match(r.pattern, ""); err != nil {
+		return route{}, fmt.Errorf("invalid route (%s): %w", s, err)
+	}
+	return r, nil
+}
+
+func newTopicRouter(routes []string, defaultTopic string) (*topicRouter, error) {
+	router := &topicRouter{
+		routes:       make([]route, 0, len(routes)),
+		defaultTopic: defaultTopic,
+		cache:        make(map[*metrics.Metric]string),
+	}
+	for _, s := range routes {
+		r, err := parseRoute(s)
+		if err != nil {
+			return nil, err
+		}
+		router.routes = append(router.routes, r)
+	}
+	return router, nil
+}
+
+// topic returns the topic of the first route matching the metric.
+func (r *topicRouter) topic(metric *metrics.Metric) string {
+	if topic, ok := r.cache[metric]; ok {
+		return topic
+	}
+
+	topic := r.defaultTopic
+	for _, route := range r.routes {
+		if route.matches(metric) {
+			topic = route.topic
+			break
+		}
+	}
+	r.cache[metric] = topic
+	return topic
+}
+
+// topics returns all the topics the router can send samples to.
+func (r *topicRouter) topics() []string {
+	topics := []string{r.defaultTopic}
+	seen := map[string]bool{r.defaultTopic: true}
+	for _, route := range r.routes {
+		if !seen[route.topic] {
+			seen[route.topic] = true
+			topics = append(topics, route.topic)
+		}
+	}
+	return topics
+}
+
+func (r route) matches(metric *metrics.Metric) bool {
+	if r.isType {
+		return metric.Type == r.metricType
+	}
+	matched, _ := path.Match(r.pattern, metric.Name)
+	return matched
+}
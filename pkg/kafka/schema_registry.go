@@ -0,0 +1,200 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.k6.io/k6/lib/fsext"
+	"gopkg.in/guregu/null.v3"
+)
+
+const (
+	schemaRegistryContentType = "application/vnd.schemaregistry.v1+json"
+	schemaRegistryMagicByte   = 0
+)
+
+type schemaRegistryConfig struct {
+	URL      null.String `json:"url" envconfig:"K6_KAFKA_SCHEMA_REGISTRY_URL"`
+	User     null.String `json:"user" envconfig:"K6_KAFKA_SCHEMA_REGISTRY_USER"`
+	Password null.String `json:"password" envconfig:"K6_KAFKA_SCHEMA_REGISTRY_PASSWORD"`
+	Subject  null.String `json:"subject" envconfig:"K6_KAFKA_SCHEMA_REGISTRY_SUBJECT"`
+	// PasswordFile is read again for every request, so the password can be
+	// rotated.
+	PasswordFile null.String `json:"passwordFile" envconfig:"K6_KAFKA_SCHEMA_REGISTRY_PASSWORD_FILE"`
+}
+
+func (c schemaRegistryConfig) Apply(cfg schemaRegistryConfig) schemaRegistryConfig {
+	if cfg.URL.Valid {
+		c.URL = cfg.URL
+	}
+	if cfg.User.Valid {
+		c.User = cfg.User
+	}
+	if cfg.Password.Valid {
+		c.Password = cfg.Password
+	}
+	if cfg.Subject.Valid {
+		c.Subject = cfg.Subject
+	}
+	if cfg.PasswordFile.Valid {
+		c.PasswordFile = cfg.PasswordFile
+	}
+	return c
+}
+
+// schemaRegistryParseMap parses a map[string]interface{} into a schemaRegistryConfig
+func schemaRegistryParseMap(m map[string]interface{}) (schemaRegistryConfig, error) {
+	c := schemaRegistryConfig{}
+	if v, ok := m["url"].(string); ok {
+		c.URL = null.StringFrom(v)
+		delete(m, "url")
+	}
+	if v, ok := m["user"].(string); ok {
+		c.User = null.StringFrom(v)
+		delete(m, "user")
+	}
+	if v, ok := m["password"].(string); ok {
+		c.Password = null.StringFrom(v)
+		delete(m, "password")
+	}
+	if v, ok := m["subject"].(string); ok {
+		c.Subject = null.StringFrom(v)
+		delete(m, "subject")
+	}
+	if v, ok := m["passwordFile"].(string); ok {
+		c.PasswordFile = null.StringFrom(v)
+		delete(m, "passwordFile")
+	}
+	if len(m) > 0 {
+		return c, errors.New("Unknown or unparsed options '" + mapToString(m) + "'")
+	}
+	return c, nil
+}
+
+// schemaRegistryClient talks to the REST API of a Confluent compatible Schema Registry.
+type schemaRegistryClient struct {
+	url          string
+	user         string
+	password     string
+	passwordFile null.String
+	fs           fsext.Fs
+	httpClient   *http.Client
+}
+
+func newSchemaRegistryClient(config schemaRegistryConfig, fs fsext.Fs) *schemaRegistryClient {
+	return &schemaRegistryClient{
+		url:          strings.TrimSuffix(config.URL.String, "/"),
+		user:         config.User.String,
+		password:     config.Password.String,
+		passwordFile: config.PasswordFile,
+		fs:           fs,
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type schemaRegistryRequest struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"`
+}
+
+type schemaRegistryResponse struct {
+	ID        int    `json:"id"`
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+// schemaID looks up the ID of the schema under the subject and registers the
+// schema if the subject doesn't have it yet. An empty schemaType means Avro.
+func (c *schemaRegistryClient) schemaID(subject, schemaType, schema string) (int, error) {
+	request := schemaRegistryRequest{Schema: schema, SchemaType: schemaType}
+	subjectPath := "/subjects/" + url.PathEscape(subject)
+
+	id, status, err := c.post(subjectPath, request)
+	if err == nil {
+		return id, nil
+	}
+	if status != http.StatusNotFound {
+		return 0, fmt.Errorf("looking up the schema for subject %q failed: %w", subject, err)
+	}
+
+	id, _, err = c.post(subjectPath+"/versions", request)
+	if err != nil {
+		return 0, fmt.Errorf("registering the schema for subject %q failed: %w", subject, err)
+	}
+	return id, nil
+}
+
+func (c *schemaRegistryClient) post(path string, request schemaRegistryRequest) (int, int, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return 0, 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", schemaRegistryContentType)
+	req.Header.Set("Accept", schemaRegistryContentType)
+	password, err := readSecret(c.fs, null.StringFrom(c.password), c.passwordFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	if c.user != "" || password != "" {
+		req.SetBasicAuth(c.user, password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, resp.StatusCode, err
+	}
+	var response schemaRegistryResponse
+	if err := json.Unmarshal(respBody, &response); err != nil {
+		return 0, resp.StatusCode, fmt.Errorf("unexpected response with status %d: %s", resp.StatusCode, respBody)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, resp.StatusCode, fmt.Errorf("status %d, error code %d: %s",
+			resp.StatusCode, response.ErrorCode, response.Message)
+	}
+	return response.ID, resp.StatusCode, nil
+}
+
+// appendSchemaRegistryHeader appends the Confluent wire format header, the magic
+// byte followed by the big-endian schema ID.
+func appendSchemaRegistryHeader(b []byte, schemaID int) []byte {
+	b = append(b, schemaRegistryMagicByte)
+	return binary.BigEndian.AppendUint32(b, uint32(schemaID))
+}
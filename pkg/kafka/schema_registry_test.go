@@ -0,0 +1,132 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/lib/fsext"
+	"gopkg.in/guregu/null.v3"
+)
+
+// newTestSchemaRegistry starts a minimal stand-in for the Schema Registry REST
+// API that keeps the registered schemas in memory.
+func newTestSchemaRegistry(t *testing.T) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	subjects := map[string]string{}
+	schemas := map[string]int{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if user != "registry-user" || password != "registry-password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error_code":401,"message":"Unauthorized"}`))
+			return
+		}
+		var req schemaRegistryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/subjects/my_topic-value":
+			if subjects[r.URL.Path] != req.Schema {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+				return
+			}
+		case "/subjects/my_topic-value/versions":
+			if _, ok := schemas[req.Schema]; !ok {
+				schemas[req.Schema] = len(schemas) + 42
+			}
+			subjects["/subjects/my_topic-value"] = req.Schema
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code":40401,"message":"Subject not found"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":` + strconv.Itoa(schemas[req.Schema]) + `}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSchemaRegistryClient(t *testing.T) {
+	t.Parallel()
+	srv := newTestSchemaRegistry(t)
+
+	client := newSchemaRegistryClient(schemaRegistryConfig{
+		URL:      null.StringFrom(srv.URL + "/"),
+		User:     null.StringFrom("registry-user"),
+		Password: null.StringFrom("registry-password"),
+	}, fsext.NewMemMapFs())
+
+	id, err := client.schemaID("my_topic-value", "", avroSampleSchema)
+	require.NoError(t, err)
+	assert.Equal(t, 42, id)
+
+	// the second time the schema is found by the lookup
+	id, err = client.schemaID("my_topic-value", "", avroSampleSchema)
+	require.NoError(t, err)
+	assert.Equal(t, 42, id)
+
+	_, err = client.schemaID("other-value", "", avroSampleSchema)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Subject not found")
+
+	client.password = "wrong"
+	_, err = client.schemaID("my_topic-value", "", avroSampleSchema)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "status 401")
+}
+
+func TestSchemaRegistryClientPasswordFile(t *testing.T) {
+	t.Parallel()
+	srv := newTestSchemaRegistry(t)
+	fs := fsext.NewMemMapFs()
+	require.NoError(t, fsext.WriteFile(fs, "/run/secrets/registry", []byte("wrong\n"), 0o600))
+
+	client := newSchemaRegistryClient(schemaRegistryConfig{
+		URL:          null.StringFrom(srv.URL),
+		User:         null.StringFrom("registry-user"),
+		PasswordFile: null.StringFrom("/run/secrets/registry"),
+	}, fs)
+	_, err := client.schemaID("my_topic-value", "", avroSampleSchema)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "status 401")
+
+	// the file is read again for every request
+	require.NoError(t, fsext.WriteFile(fs, "/run/secrets/registry", []byte("registry-password\n"), 0o600))
+	id, err := client.schemaID("my_topic-value", "", avroSampleSchema)
+	require.NoError(t, err)
+	assert.Equal(t, 42, id)
+}
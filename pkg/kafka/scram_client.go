@@ -8,9 +8,19 @@ type xDGSCRAMClient struct {
 	*scram.Client
 	*scram.ClientConversation
 	scram.HashGeneratorFcn
+
+	// credentials, when set, returns the user and password to use instead of
+	// the ones of the sarama config.
+	credentials func() (string, string, error)
 }
 
 func (x *xDGSCRAMClient) Begin(userName, password, authzID string) (err error) {
+	if x.credentials != nil {
+		userName, password, err = x.credentials()
+		if err != nil {
+			return err
+		}
+	}
 	x.Client, err = x.HashGeneratorFcn.NewClient(userName, password, authzID)
 	if err != nil {
 		return err
@@ -0,0 +1,154 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.k6.io/k6/lib/fsext"
+	"gopkg.in/guregu/null.v3"
+)
+
+const (
+	// envSecretPrefix marks the secret options whose value is the name of the
+	// environment variable that holds the secret, like password=env:KAFKA_PASSWORD.
+	envSecretPrefix = "env:"
+
+	// redacted replaces the secrets when the config is printed.
+	redacted = "[REDACTED]"
+)
+
+// secretFile is a secret option that can also be read from a file.
+type secretFile struct {
+	name  string
+	value null.String
+	file  null.String
+}
+
+func (c Config) secretFiles() []secretFile {
+	return []secretFile{
+		{"user", c.User, c.UserFile},
+		{"password", c.Password, c.PasswordFile},
+		{"keyPassphrase", c.KeyPassphrase, c.KeyPassphraseFile},
+		{"oauth.clientSecret", c.OAuth.ClientSecret, c.OAuth.ClientSecretFile},
+		{"schemaRegistry.password", c.SchemaRegistry.Password, c.SchemaRegistry.PasswordFile},
+	}
+}
+
+func (c Config) validateSecretFiles() error {
+	for _, secret := range c.secretFiles() {
+		if secret.value.Valid && secret.file.Valid {
+			return fmt.Errorf("%s and %sFile can't be set together", secret.name, secret.name)
+		}
+	}
+	// the other mechanisms take the credentials once, so the files couldn't be
+	// rotated
+	if c.UserFile.Valid || c.PasswordFile.Valid {
+		switch c.AuthMechanism.String {
+		case "scram-sha-256", "scram-sha-512":
+		default:
+			return fmt.Errorf("userFile and passwordFile require the scram-sha-256 or scram-sha-512 authMechanism, "+
+				"not %s", c.AuthMechanism.String)
+		}
+	}
+	return nil
+}
+
+// resolveEnvSecrets replaces the values of the secret options that are set to
+// env:NAME with the value of the NAME environment variable.
+func (c Config) resolveEnvSecrets(env map[string]string) (Config, error) {
+	secrets := []*null.String{
+		&c.User, &c.Password, &c.KeyPassphrase, &c.OAuth.Token, &c.OAuth.ClientSecret,
+		&c.SchemaRegistry.User, &c.SchemaRegistry.Password,
+	}
+	for _, secret := range secrets {
+		if !secret.Valid || !strings.HasPrefix(secret.String, envSecretPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(secret.String, envSecretPrefix)
+		value, ok := env[name]
+		if !ok {
+			return c, fmt.Errorf("the %s environment variable of a secret option isn't set", name)
+		}
+		secret.String = value
+	}
+	return c, nil
+}
+
+// readSecret returns the secret from its file, without the trailing line
+// break, when the file is set, and value otherwise.
+func readSecret(fs fsext.Fs, value, file null.String) (string, error) {
+	if !file.Valid {
+		return value.String, nil
+	}
+	b, err := fsext.ReadFile(fs, file.String)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read the secret file: %w", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// saslCredentials reads the SASL user and password, the files are read again
+// every time so new connections use rotated credentials.
+func (c Config) saslCredentials(fs fsext.Fs) func() (string, string, error) {
+	return func() (string, string, error) {
+		user, err := readSecret(fs, c.User, c.UserFile)
+		if err != nil {
+			return "", "", err
+		}
+		password, err := readSecret(fs, c.Password, c.PasswordFile)
+		if err != nil {
+			return "", "", err
+		}
+		return user, password, nil
+	}
+}
+
+// redacted returns a copy of the config with the secrets replaced.
+func (c Config) redacted() Config {
+	secrets := []*null.String{
+		&c.Password, &c.KeyPassphrase, &c.OAuth.Token, &c.OAuth.ClientSecret, &c.SchemaRegistry.Password,
+	}
+	for _, secret := range secrets {
+		if secret.Valid {
+			*secret = null.StringFrom(redacted)
+		}
+	}
+	return c
+}
+
+// MarshalJSON marshals the config with the secrets redacted, so they don't end
+// up in logs.
+func (c Config) MarshalJSON() ([]byte, error) {
+	type config Config // without the MarshalJSON method
+	return json.Marshal(config(c.redacted()))
+}
+
+// String returns the config as JSON, with the secrets redacted.
+func (c Config) String() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
@@ -0,0 +1,89 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/lib/fsext"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestConfigRedactsSecrets(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		User:          null.StringFrom("testuser"),
+		Password:      null.StringFrom("password123"),
+		KeyPassphrase: null.StringFrom("passphrase123"),
+		OAuth: oauthConfig{
+			Token:        null.StringFrom("token123"),
+			ClientSecret: null.StringFrom("clientsecret123"),
+		},
+		SchemaRegistry: schemaRegistryConfig{Password: null.StringFrom("registry123")},
+	}
+
+	b, err := json.Marshal(config)
+	require.NoError(t, err)
+	for _, printed := range []string{string(b), config.String(), fmt.Sprintf("%v", config)} {
+		assert.Contains(t, printed, `"user":"testuser"`)
+		for _, secret := range []string{"password123", "passphrase123", "token123", "clientsecret123", "registry123"} {
+			assert.NotContains(t, printed, secret)
+		}
+	}
+
+	// the config itself keeps the secrets
+	assert.Equal(t, null.StringFrom("password123"), config.Password)
+}
+
+func TestSASLCredentialsFromFiles(t *testing.T) {
+	t.Parallel()
+	fs := fsext.NewMemMapFs()
+	require.NoError(t, fsext.WriteFile(fs, "/run/secrets/user", []byte("testuser\n"), 0o600))
+	require.NoError(t, fsext.WriteFile(fs, "/run/secrets/password", []byte("password123\n"), 0o600))
+	config := Config{
+		AuthMechanism: null.StringFrom("scram-sha-256"),
+		UserFile:      null.StringFrom("/run/secrets/user"),
+		PasswordFile:  null.StringFrom("/run/secrets/password"),
+		Version:       null.StringFrom("2.1.0"),
+	}
+
+	saramaConfig, err := newSaramaConfig(config, fs, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "testuser", saramaConfig.Net.SASL.User)
+	assert.Equal(t, "password123", saramaConfig.Net.SASL.Password)
+
+	// a new connection uses the rotated password
+	require.NoError(t, fsext.WriteFile(fs, "/run/secrets/password", []byte("rotated456\n"), 0o600))
+	client := saramaConfig.Net.SASL.SCRAMClientGeneratorFunc().(*xDGSCRAMClient) //nolint:forcetypeassert
+	require.NoError(t, client.Begin(saramaConfig.Net.SASL.User, saramaConfig.Net.SASL.Password, ""))
+	user, password, err := client.credentials()
+	require.NoError(t, err)
+	assert.Equal(t, "testuser", user)
+	assert.Equal(t, "rotated456", password)
+
+	config.PasswordFile = null.StringFrom("/run/secrets/missing")
+	_, err = newSaramaConfig(config, fs, nil)
+	require.ErrorContains(t, err, "couldn't read the secret file")
+}
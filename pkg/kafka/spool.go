@@ -0,0 +1,665 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.k6.io/k6/lib/fsext"
+	"go.k6.io/k6/lib/types"
+	"gopkg.in/guregu/null.v3"
+)
+
+// The eviction policies of a full spool.
+const (
+	spoolDropOldest = "drop-oldest"
+	spoolDropNewest = "drop-newest"
+)
+
+const (
+	defaultSpoolMaxBytes     = 1 << 30
+	defaultSpoolDrainTimeout = 30 * time.Second
+
+	// spoolSegmentMaxBytes is the size after which the spool starts a new
+	// segment file, segments are evicted and replayed as a whole.
+	spoolSegmentMaxBytes = 8 << 20
+	spoolSegmentExt      = ".spool"
+
+	// spoolReplayInterval is how often the spooled messages are replayed while
+	// the test runs, spoolReplayBatch how many are sent at once.
+	spoolReplayInterval = 5 * time.Second
+	spoolReplayBatch    = 500
+
+	// spoolDrainRetry is how long Stop waits before replaying again when
+	// draining the spool fails.
+	spoolDrainRetry = time.Second
+)
+
+type spoolConfig struct {
+	Dir          null.String        `json:"dir" envconfig:"K6_KAFKA_SPOOL_DIR"`
+	MaxBytes     null.Int           `json:"maxBytes" envconfig:"K6_KAFKA_SPOOL_MAX_BYTES"`
+	Eviction     null.String        `json:"eviction" envconfig:"K6_KAFKA_SPOOL_EVICTION"`
+	Drain        null.Bool          `json:"drain" envconfig:"K6_KAFKA_SPOOL_DRAIN"`
+	DrainTimeout types.NullDuration `json:"drainTimeout" envconfig:"K6_KAFKA_SPOOL_DRAIN_TIMEOUT"`
+}
+
+func (c spoolConfig) Apply(cfg spoolConfig) spoolConfig {
+	if cfg.Dir.Valid {
+		c.Dir = cfg.Dir
+	}
+	if cfg.MaxBytes.Valid {
+		c.MaxBytes = cfg.MaxBytes
+	}
+	if cfg.Eviction.Valid {
+		c.Eviction = cfg.Eviction
+	}
+	if cfg.Drain.Valid {
+		c.Drain = cfg.Drain
+	}
+	if cfg.DrainTimeout.Valid {
+		c.DrainTimeout = cfg.DrainTimeout
+	}
+	return c
+}
+
+// spoolParseMap parses a map[string]interface{} into a spoolConfig
+func spoolParseMap(m map[string]interface{}) (spoolConfig, error) {
+	c := spoolConfig{}
+	if v, ok := m["dir"].(string); ok {
+		c.Dir = null.StringFrom(v)
+		delete(m, "dir")
+	}
+	if v, ok := m["maxBytes"].(int64); ok {
+		c.MaxBytes = null.IntFrom(v)
+		delete(m, "maxBytes")
+	}
+	if v, ok := m["eviction"].(string); ok {
+		c.Eviction = null.StringFrom(v)
+		delete(m, "eviction")
+	}
+	if v, ok := m["drain"].(bool); ok {
+		c.Drain = null.BoolFrom(v)
+		delete(m, "drain")
+	}
+	if v, ok := m["drainTimeout"].(string); ok {
+		if err := c.DrainTimeout.UnmarshalText([]byte(v)); err != nil {
+			return c, err
+		}
+		delete(m, "drainTimeout")
+	}
+	if len(m) > 0 {
+		return c, errors.New("Unknown or unparsed options '" + mapToString(m) + "'")
+	}
+	return c, nil
+}
+
+func (c Config) validateSpool() error {
+	if !c.Spool.Dir.Valid {
+		return nil
+	}
+	if c.Spool.Dir.String == "" {
+		return errors.New("spool.dir can't be empty")
+	}
+	if c.Spool.MaxBytes.Valid && c.Spool.MaxBytes.Int64 <= 0 {
+		return fmt.Errorf("spool.maxBytes should be positive but was %d", c.Spool.MaxBytes.Int64)
+	}
+	switch c.Spool.Eviction.String {
+	case "", spoolDropOldest, spoolDropNewest:
+	default:
+		return fmt.Errorf("invalid spool.eviction (%s), it should be one of %s or %s",
+			c.Spool.Eviction.String, spoolDropOldest, spoolDropNewest)
+	}
+	if c.Spool.DrainTimeout.Valid && time.Duration(c.Spool.DrainTimeout.Duration) <= 0 {
+		return fmt.Errorf("spool.drainTimeout should be positive but was %s", c.Spool.DrainTimeout.Duration)
+	}
+	return nil
+}
+
+// spoolRecord is a message as it's written to a segment file, one JSON
+// document per line.
+type spoolRecord struct {
+	Topic     string                `json:"topic"`
+	Key       []byte                `json:"key,omitempty"`
+	Value     []byte                `json:"value"`
+	Headers   []sarama.RecordHeader `json:"headers,omitempty"`
+	Timestamp time.Time             `json:"timestamp"`
+}
+
+func encodeSpoolRecord(message *sarama.ProducerMessage) ([]byte, error) {
+	record := spoolRecord{Topic: message.Topic, Headers: message.Headers, Timestamp: message.Timestamp}
+	var err error
+	if message.Key != nil {
+		if record.Key, err = message.Key.Encode(); err != nil {
+			return nil, err
+		}
+	}
+	if message.Value != nil {
+		if record.Value, err = message.Value.Encode(); err != nil {
+			return nil, err
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+func (r spoolRecord) message() *sarama.ProducerMessage {
+	message := &sarama.ProducerMessage{
+		Topic:     r.Topic,
+		Value:     sarama.ByteEncoder(r.Value),
+		Headers:   r.Headers,
+		Timestamp: r.Timestamp,
+	}
+	if r.Key != nil {
+		message.Key = sarama.ByteEncoder(r.Key)
+	}
+	return message
+}
+
+type spoolSegment struct {
+	seq     uint64
+	size    int64
+	records int
+	// previousRun is set for the segments left behind by a previous run.
+	previousRun bool
+}
+
+// spool keeps the messages that couldn't be delivered in segment files, so they
+// can be replayed in order once the brokers are back, even by a later test run.
+// Only the newest segment is written to, and only the oldest is replayed.
+type spool struct {
+	fs           fsext.Fs
+	dir          string
+	maxBytes     int64
+	eviction     string
+	segmentBytes int64
+
+	mu       sync.Mutex
+	segments []*spoolSegment
+	size     int64
+	nextSeq  uint64
+	// writer is the open newest segment, nil once it's sealed.
+	writer io.WriteCloser
+	// replaying is the segment being replayed, which can't be evicted, and
+	// replayed how many of the first records of the oldest segment are done
+	// with. done has the records after those that were delivered, or dropped
+	// because they can never be.
+	replaying *spoolSegment
+	replayed  int
+	done      map[int]bool
+	dropped   int64
+}
+
+// spoolEntry is a spooled message and its position in its segment.
+type spoolEntry struct {
+	index   int
+	message *sarama.ProducerMessage
+}
+
+// openSpool opens the spool directory, picking up the segments left behind by
+// a previous run.
+func openSpool(fs fsext.Fs, c spoolConfig) (*spool, error) {
+	s := &spool{
+		fs:           fs,
+		dir:          c.Dir.String,
+		maxBytes:     defaultSpoolMaxBytes,
+		eviction:     spoolDropOldest,
+		segmentBytes: spoolSegmentMaxBytes,
+		done:         make(map[int]bool),
+	}
+	if c.MaxBytes.Valid {
+		s.maxBytes = c.MaxBytes.Int64
+	}
+	if c.Eviction.Valid {
+		s.eviction = c.Eviction.String
+	}
+
+	if err := fs.MkdirAll(s.dir, 0o750); err != nil {
+		return nil, fmt.Errorf("couldn't create spool.dir: %w", err)
+	}
+	entries, err := fsext.ReadDir(fs, s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read spool.dir: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		seq, parseErr := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if parseErr != nil {
+			continue
+		}
+		b, readErr := fsext.ReadFile(fs, s.segmentPath(seq))
+		if readErr != nil {
+			return nil, fmt.Errorf("couldn't read the spool segment %s: %w", name, readErr)
+		}
+		s.segments = append(s.segments, &spoolSegment{
+			seq: seq, size: int64(len(b)), records: bytes.Count(b, []byte{'\n'}), previousRun: true,
+		})
+		s.size += int64(len(b))
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+	return s, nil
+}
+
+func (s *spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExt))
+}
+
+// append writes the messages at the end of the spool. When the spool is full,
+// the oldest segments are evicted or the messages are dropped, depending on the
+// eviction policy.
+func (s *spool) append(messages ...*sarama.ProducerMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, message := range messages {
+		line, err := encodeSpoolRecord(message)
+		if err != nil {
+			return err
+		}
+		if !s.makeRoom(int64(len(line))) {
+			s.dropped++
+			continue
+		}
+		if err := s.write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeRoom evicts the oldest segments, with the drop-oldest policy, until n
+// more bytes fit in the spool. It returns false if they still don't fit.
+func (s *spool) makeRoom(n int64) bool {
+	if n > s.maxBytes {
+		return false
+	}
+	for s.size+n > s.maxBytes {
+		if s.eviction != spoolDropOldest || len(s.segments) == 0 || s.segments[0] == s.replaying {
+			return false
+		}
+		oldest := s.segments[0]
+		if len(s.segments) == 1 && s.writer != nil {
+			_ = s.writer.Close()
+			s.writer = nil
+		}
+		if err := s.fs.Remove(s.segmentPath(oldest.seq)); err != nil {
+			return false
+		}
+		s.segments = s.segments[1:]
+		s.size -= oldest.size
+		s.dropped += int64(oldest.records - s.replayed - len(s.done))
+		s.replayed = 0
+		s.done = make(map[int]bool)
+	}
+	return true
+}
+
+// write appends a line to the newest segment, starting a new one if there's no
+// open segment or it's full.
+func (s *spool) write(line []byte) error {
+	if s.writer == nil || s.segments[len(s.segments)-1].size >= s.segmentBytes {
+		if s.writer != nil {
+			if err := s.writer.Close(); err != nil {
+				return err
+			}
+		}
+		seq := s.nextSeq
+		writer, err := s.fs.Create(s.segmentPath(seq))
+		if err != nil {
+			return fmt.Errorf("couldn't create a spool segment: %w", err)
+		}
+		s.writer = writer
+		s.nextSeq++
+		s.segments = append(s.segments, &spoolSegment{seq: seq})
+	}
+	if _, err := s.writer.Write(line); err != nil {
+		return fmt.Errorf("couldn't write to the spool: %w", err)
+	}
+	segment := s.segments[len(s.segments)-1]
+	segment.size += int64(len(line))
+	segment.records++
+	s.size += int64(len(line))
+	return nil
+}
+
+// replay sends the spooled messages, oldest first, until the spool is empty or
+// some of them fail with an error that retrying could fix. The messages that
+// fail with another error are dropped, as they can never be delivered. The
+// segments are removed once all their messages are done with, so a message can
+// be sent twice if the output stops in the middle of a segment. send is told if
+// the messages were spooled by a previous run.
+func (s *spool) replay(send func(messages []*sarama.ProducerMessage, previousRun bool) error) (int, error) {
+	replayed := 0
+	for {
+		segment, entries, err := s.nextSegment()
+		if err != nil || segment == nil {
+			return replayed, err
+		}
+		for len(entries) > 0 {
+			n := len(entries)
+			if n > spoolReplayBatch {
+				n = spoolReplayBatch
+			}
+			delivered, sendErr := s.sendBatch(entries[:n], func(messages []*sarama.ProducerMessage) error {
+				return send(messages, segment.previousRun)
+			})
+			replayed += delivered
+			if sendErr != nil {
+				s.mu.Lock()
+				s.replaying = nil
+				s.mu.Unlock()
+				return replayed, sendErr
+			}
+			entries = entries[n:]
+		}
+		if err := s.removeReplayed(segment); err != nil {
+			return replayed, err
+		}
+	}
+}
+
+// sendBatch sends a batch of entries and marks the ones that were delivered, or
+// that can never be, as done. It returns how many were delivered, and an error
+// if some of them may still be delivered later.
+func (s *spool) sendBatch(batch []spoolEntry, send func([]*sarama.ProducerMessage) error) (int, error) {
+	messages := make([]*sarama.ProducerMessage, len(batch))
+	for i, entry := range batch {
+		messages[i] = entry.message
+	}
+	err := send(messages)
+	failed := make(map[*sarama.ProducerMessage]error)
+	if err != nil {
+		var producerErrs sarama.ProducerErrors
+		if !errors.As(err, &producerErrs) {
+			// nothing tells which messages went through
+			return 0, err
+		}
+		for _, producerErr := range producerErrs {
+			failed[producerErr.Msg] = producerErr.Err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delivered := 0
+	var retryErr error
+	for _, entry := range batch {
+		failErr, ok := failed[entry.message]
+		switch {
+		case !ok:
+			delivered++
+		case isRetriableDeliveryError(failErr):
+			if retryErr == nil {
+				retryErr = fmt.Errorf("couldn't deliver all the spooled messages: %w", failErr)
+			}
+			continue
+		default:
+			s.dropped++
+		}
+		s.done[entry.index] = true
+	}
+	for s.done[s.replayed] {
+		delete(s.done, s.replayed)
+		s.replayed++
+	}
+	return delivered, retryErr
+}
+
+// nextSegment returns the oldest segment and the entries of it that weren't
+// replayed yet, sealing it first if it's still written to.
+func (s *spool) nextSegment() (*spoolSegment, []spoolEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) == 0 {
+		return nil, nil, nil
+	}
+	segment := s.segments[0]
+	if len(s.segments) == 1 && s.writer != nil {
+		if err := s.writer.Close(); err != nil {
+			return nil, nil, err
+		}
+		s.writer = nil
+	}
+	b, err := fsext.ReadFile(s.fs, s.segmentPath(segment.seq))
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't read a spool segment: %w", err)
+	}
+
+	var entries []spoolEntry
+	for i, line := range bytes.SplitAfter(b, []byte{'\n'}) {
+		if len(line) == 0 || i < s.replayed || s.done[i] {
+			continue
+		}
+		var record spoolRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			// a line cut short when a previous run was killed
+			s.dropped++
+			s.done[i] = true
+			continue
+		}
+		entries = append(entries, spoolEntry{index: i, message: record.message()})
+	}
+	s.replaying = segment
+	return segment, entries, nil
+}
+
+func (s *spool) removeReplayed(segment *spoolSegment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.replaying = nil
+	s.replayed = 0
+	s.done = make(map[int]bool)
+	if err := s.fs.Remove(s.segmentPath(segment.seq)); err != nil {
+		return fmt.Errorf("couldn't remove a replayed spool segment: %w", err)
+	}
+	s.segments = s.segments[1:]
+	s.size -= segment.size
+	return nil
+}
+
+// pending returns how many messages are waiting to be replayed.
+func (s *spool) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := -s.replayed - len(s.done)
+	for _, segment := range s.segments {
+		pending += segment.records
+	}
+	return pending
+}
+
+// droppedMessages returns how many messages were dropped or evicted because
+// the spool was full, or dropped because they could never be delivered.
+func (s *spool) droppedMessages() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Close()
+	s.writer = nil
+	return err
+}
+
+// newReplayProducer creates the producer the spooled messages are replayed
+// with. It's synchronous, to know when the brokers are back, and produces
+// outside of transactions.
+func newReplayProducer(config Config, fs fsext.Fs, env map[string]string) (sarama.SyncProducer, error) {
+	saramaConfig, err := newSaramaConfig(config, fs, env)
+	if err != nil {
+		return nil, err
+	}
+	saramaConfig.Producer.Return.Successes = true
+	saramaConfig.Producer.Return.Errors = true
+	saramaConfig.Producer.Transaction.ID = ""
+	return sarama.NewSyncProducer(config.Brokers, saramaConfig)
+}
+
+// startSpoolReplay replays the spool right away, to deliver what a previous run
+// left behind, and then periodically.
+func (o *Output) startSpoolReplay() {
+	o.spoolDone = make(chan struct{})
+	o.spoolWg.Add(1)
+	go func() {
+		defer o.spoolWg.Done()
+		ticker := time.NewTicker(spoolReplayInterval)
+		defer ticker.Stop()
+		for {
+			o.replaySpool()
+			select {
+			case <-ticker.C:
+			case <-o.spoolDone:
+				return
+			}
+		}
+	}()
+}
+
+func (o *Output) replaySpool() error {
+	replayed, err := o.spool.replay(func(messages []*sarama.ProducerMessage, previousRun bool) error {
+		sendErr := o.replayProducer.SendMessages(messages)
+		var producerErrs sarama.ProducerErrors
+		if sendErr != nil && !errors.As(sendErr, &producerErrs) {
+			return sendErr
+		}
+		failed := make(map[*sarama.ProducerMessage]bool, len(producerErrs))
+		for _, producerErr := range producerErrs {
+			failed[producerErr.Msg] = true
+			if !isRetriableDeliveryError(producerErr.Err) {
+				o.logger.WithError(producerErr.Err).WithField("topic", producerErr.Msg.Topic).
+					Warn("Kafka: Dropping a spooled message that can't be delivered")
+			}
+		}
+		for _, message := range messages {
+			switch {
+			case failed[message]:
+			case previousRun:
+				o.stats.replayedPrevious(message)
+			default:
+				o.stats.replayed(message)
+			}
+		}
+		return sendErr
+	})
+	if replayed > 0 {
+		o.logger.WithField("messages", replayed).Info("Kafka: Replayed spooled messages")
+	}
+	if err != nil {
+		o.logger.WithError(err).Debug("Kafka: Couldn't replay the spooled messages, retrying later...")
+	}
+	return err
+}
+
+// isRetriableDeliveryError tells if a message that failed with err may still
+// be delivered once the brokers are back, as opposed to errors like a message
+// that's too large or a topic that can't be written to.
+func isRetriableDeliveryError(err error) bool {
+	var kerr sarama.KError
+	if errors.As(err, &kerr) {
+		switch kerr {
+		// the errors the sarama producer retries, and those of unreachable brokers
+		case sarama.ErrInvalidMessage, sarama.ErrUnknownTopicOrPartition, sarama.ErrLeaderNotAvailable,
+			sarama.ErrNotLeaderForPartition, sarama.ErrRequestTimedOut, sarama.ErrNotEnoughReplicas,
+			sarama.ErrNotEnoughReplicasAfterAppend, sarama.ErrBrokerNotAvailable, sarama.ErrNetworkException:
+			return true
+		default:
+			return false
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, sarama.ErrOutOfBrokers) ||
+		errors.Is(err, sarama.ErrNotConnected) ||
+		errors.Is(err, sarama.ErrShuttingDown) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// spoolMessages appends the messages that couldn't be delivered to the spool.
+func (o *Output) spoolMessages(messages ...*sarama.ProducerMessage) {
+	if err := o.spool.append(messages...); err != nil {
+		o.logger.WithError(err).Error("Kafka: Failed to spool the messages")
+	}
+}
+
+// stopSpool stops the periodic replay and, unless spool.drain is false, tries
+// to replay what's left until spool.drainTimeout. The messages that are still
+// spooled are left in spool.dir for a later run.
+func (o *Output) stopSpool() {
+	close(o.spoolDone)
+	o.spoolWg.Wait()
+
+	if !o.Config.Spool.Drain.Valid || o.Config.Spool.Drain.Bool {
+		timeout := defaultSpoolDrainTimeout
+		if o.Config.Spool.DrainTimeout.Valid {
+			timeout = time.Duration(o.Config.Spool.DrainTimeout.Duration)
+		}
+		o.logger.Debug("Kafka: Draining the spool...")
+		deadline := time.Now().Add(timeout)
+		for o.spool.pending() > 0 && o.replaySpool() != nil && time.Until(deadline) > spoolDrainRetry {
+			time.Sleep(spoolDrainRetry)
+		}
+	}
+
+	if dropped := o.spool.droppedMessages(); dropped > 0 {
+		o.logger.WithField("messages", dropped).Warn("Kafka: Messages were dropped because the spool was full")
+	}
+	if pending := o.spool.pending(); pending > 0 {
+		o.logger.WithField("messages", pending).WithField("dir", o.Config.Spool.Dir.String).
+			Warn("Kafka: Spooled messages were left for a later run")
+	}
+	if err := o.replayProducer.Close(); err != nil {
+		o.logger.WithError(err).Error("Kafka: Failed to close the replay producer")
+	}
+	if err := o.spool.close(); err != nil {
+		o.logger.WithError(err).Error("Kafka: Failed to close the spool")
+	}
+}
@@ -0,0 +1,369 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/lib/fsext"
+	"go.k6.io/k6/lib/testutils"
+	"go.k6.io/k6/lib/types"
+	"go.k6.io/k6/metrics"
+	"gopkg.in/guregu/null.v3"
+)
+
+func newSpoolTestMessages(from, to int) []*sarama.ProducerMessage {
+	var messages []*sarama.ProducerMessage
+	for i := from; i < to; i++ {
+		messages = append(messages, &sarama.ProducerMessage{
+			Topic:     "my_topic",
+			Key:       sarama.StringEncoder(fmt.Sprintf("key-%d", i)),
+			Value:     sarama.StringEncoder(fmt.Sprintf("value-%d", i)),
+			Headers:   []sarama.RecordHeader{{Key: []byte("k6"), Value: []byte("test")}},
+			Timestamp: time.Date(2024, 3, 1, 12, 0, i, 0, time.UTC),
+		})
+	}
+	return messages
+}
+
+// collectValues returns a send function that records the values of the sent
+// messages, failing when failAfter values were sent.
+func collectValues(values *[]string, failAfter int) func([]*sarama.ProducerMessage, bool) error {
+	return func(messages []*sarama.ProducerMessage, _ bool) error {
+		if len(*values)+len(messages) > failAfter {
+			return sarama.ErrOutOfBrokers
+		}
+		for _, message := range messages {
+			value, _ := message.Value.Encode()
+			*values = append(*values, string(value))
+		}
+		return nil
+	}
+}
+
+func TestSpoolReplay(t *testing.T) {
+	t.Parallel()
+	fs := fsext.NewMemMapFs()
+	s, err := openSpool(fs, spoolConfig{Dir: null.StringFrom("/spool")})
+	require.NoError(t, err)
+	s.segmentBytes = 300
+
+	require.NoError(t, s.append(newSpoolTestMessages(0, 10)...))
+	assert.Equal(t, 10, s.pending())
+	entries, err := fsext.ReadDir(fs, "/spool")
+	require.NoError(t, err)
+	assert.Greater(t, len(entries), 1)
+
+	// the brokers are down
+	var values []string
+	replayed, err := s.replay(collectValues(&values, 0))
+	require.ErrorIs(t, err, sarama.ErrOutOfBrokers)
+	assert.Equal(t, 0, replayed)
+	assert.Equal(t, 10, s.pending())
+
+	// a spool opened again, like by a later run, picks up the segments
+	require.NoError(t, s.close())
+	s, err = openSpool(fs, spoolConfig{Dir: null.StringFrom("/spool")})
+	require.NoError(t, err)
+	assert.Equal(t, 10, s.pending())
+	require.NoError(t, s.append(newSpoolTestMessages(10, 12)...))
+
+	replayed, err = s.replay(collectValues(&values, 100))
+	require.NoError(t, err)
+	assert.Equal(t, 12, replayed)
+	assert.Equal(t, 0, s.pending())
+	expected := make([]string, 0, 12)
+	for i := 0; i < 12; i++ {
+		expected = append(expected, fmt.Sprintf("value-%d", i))
+	}
+	assert.Equal(t, expected, values)
+
+	entries, err = fsext.ReadDir(fs, "/spool")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestSpoolRecordRoundTrip(t *testing.T) {
+	t.Parallel()
+	s, err := openSpool(fsext.NewMemMapFs(), spoolConfig{Dir: null.StringFrom("/spool")})
+	require.NoError(t, err)
+	message := newSpoolTestMessages(0, 1)[0]
+	require.NoError(t, s.append(message, &sarama.ProducerMessage{Topic: "other", Value: sarama.StringEncoder("v")}))
+
+	var replayed []*sarama.ProducerMessage
+	_, err = s.replay(func(messages []*sarama.ProducerMessage, _ bool) error {
+		replayed = append(replayed, messages...)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, replayed, 2)
+	assert.Equal(t, message.Topic, replayed[0].Topic)
+	assert.Equal(t, sarama.ByteEncoder("key-0"), replayed[0].Key)
+	assert.Equal(t, sarama.ByteEncoder("value-0"), replayed[0].Value)
+	assert.Equal(t, message.Headers, replayed[0].Headers)
+	assert.True(t, message.Timestamp.Equal(replayed[0].Timestamp))
+	assert.Nil(t, replayed[1].Key)
+}
+
+func TestSpoolEviction(t *testing.T) {
+	t.Parallel()
+	messageSize := func() int64 {
+		line, err := encodeSpoolRecord(newSpoolTestMessages(0, 1)[0])
+		require.NoError(t, err)
+		return int64(len(line))
+	}()
+
+	for _, eviction := range []string{spoolDropOldest, spoolDropNewest} {
+		eviction := eviction
+		t.Run(eviction, func(t *testing.T) {
+			t.Parallel()
+			s, err := openSpool(fsext.NewMemMapFs(), spoolConfig{
+				Dir:      null.StringFrom("/spool"),
+				MaxBytes: null.IntFrom(4 * messageSize),
+				Eviction: null.StringFrom(eviction),
+			})
+			require.NoError(t, err)
+			s.segmentBytes = 2 * messageSize
+
+			require.NoError(t, s.append(newSpoolTestMessages(0, 6)...))
+			assert.Equal(t, 4, s.pending())
+			assert.Equal(t, int64(2), s.droppedMessages())
+
+			var values []string
+			_, err = s.replay(collectValues(&values, 100))
+			require.NoError(t, err)
+			if eviction == spoolDropOldest {
+				assert.Equal(t, []string{"value-2", "value-3", "value-4", "value-5"}, values)
+			} else {
+				assert.Equal(t, []string{"value-0", "value-1", "value-2", "value-3"}, values)
+			}
+		})
+	}
+}
+
+func TestSpoolReplayDropsUndeliverableMessages(t *testing.T) {
+	t.Parallel()
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("my_topic", 0, broker.BrokerID()).
+			SetLeader("large_topic", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).
+			SetVersion(3).
+			SetError("large_topic", 0, sarama.ErrMessageSizeTooLarge),
+	})
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Producer.Return.Successes = true
+	saramaConfig.Producer.Retry.Max = 0
+	producer, err := sarama.NewSyncProducer([]string{broker.Addr()}, saramaConfig)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, producer.Close())
+	}()
+
+	s, err := openSpool(fsext.NewMemMapFs(), spoolConfig{Dir: null.StringFrom("/spool")})
+	require.NoError(t, err)
+	messages := newSpoolTestMessages(0, 3)
+	messages[1].Topic = "large_topic"
+	require.NoError(t, s.append(messages...))
+
+	replay := func() (int, error) {
+		return s.replay(func(messages []*sarama.ProducerMessage, _ bool) error {
+			return producer.SendMessages(messages)
+		})
+	}
+	replayed, err := replay()
+	require.NoError(t, err)
+	assert.Equal(t, 2, replayed)
+	assert.Equal(t, 0, s.pending())
+	assert.Equal(t, int64(1), s.droppedMessages())
+
+	requests := len(broker.History())
+	replayed, err = replay()
+	require.NoError(t, err)
+	assert.Equal(t, 0, replayed)
+	assert.Len(t, broker.History(), requests)
+}
+
+func TestSpoolReplayResumesAfterFailedMessages(t *testing.T) {
+	t.Parallel()
+	s, err := openSpool(fsext.NewMemMapFs(), spoolConfig{Dir: null.StringFrom("/spool")})
+	require.NoError(t, err)
+	require.NoError(t, s.append(newSpoolTestMessages(0, 4)...))
+
+	var values []string
+	_, err = s.replay(func(messages []*sarama.ProducerMessage, _ bool) error {
+		// value-1 fails until the brokers are back, value-2 never gets through
+		return sarama.ProducerErrors{
+			{Msg: messages[1], Err: sarama.ErrNotEnoughReplicas},
+			{Msg: messages[2], Err: sarama.ErrTopicAuthorizationFailed},
+		}
+	})
+	require.ErrorIs(t, err, sarama.ErrNotEnoughReplicas)
+	assert.Equal(t, 1, s.pending())
+	assert.Equal(t, int64(1), s.droppedMessages())
+
+	replayed, err := s.replay(collectValues(&values, 100))
+	require.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, []string{"value-1"}, values)
+	assert.Equal(t, 0, s.pending())
+}
+
+func TestIsRetriableDeliveryError(t *testing.T) {
+	t.Parallel()
+	for _, err := range []error{
+		sarama.ErrOutOfBrokers, sarama.ErrNotEnoughReplicas, sarama.ErrLeaderNotAvailable,
+		fmt.Errorf("wrapped: %w", sarama.ErrRequestTimedOut), &net.OpError{Op: "dial", Err: errors.New("refused")},
+	} {
+		assert.True(t, isRetriableDeliveryError(err), err.Error())
+	}
+	for _, err := range []error{
+		sarama.ErrMessageSizeTooLarge, sarama.ErrTopicAuthorizationFailed, sarama.ErrInvalidRecord,
+		errors.New("something else"),
+	} {
+		assert.False(t, isRetriableDeliveryError(err), err.Error())
+	}
+}
+
+func TestOutputSpoolsFailedMessages(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("my_metric", metrics.Counter)
+	require.NoError(t, err)
+	sample := metrics.Sample{
+		TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()},
+		Value:      1,
+	}
+
+	fs := fsext.NewMemMapFs()
+	config := NewConfig()
+	config.Topic = null.StringFrom("my_topic")
+	config.LogError = null.BoolFrom(false)
+	config.Spool = spoolConfig{Dir: null.StringFrom("/spool"), DrainTimeout: types.NullDurationFrom(5 * time.Second)}
+	s, err := openSpool(fs, config.Spool)
+	require.NoError(t, err)
+
+	producer := mocks.NewAsyncProducer(t, nil)
+	producer.ExpectInputAndFail(sarama.ErrOutOfBrokers)
+	producer.ExpectInputAndFail(sarama.ErrOutOfBrokers)
+	replayProducer := mocks.NewSyncProducer(t, nil)
+	// the first replay at Start finds an empty spool, the drain at Stop fails
+	// once and then delivers both messages
+	replayProducer.ExpectSendMessageAndFail(sarama.ErrOutOfBrokers)
+	replayProducer.ExpectSendMessageAndSucceed()
+	replayProducer.ExpectSendMessageAndSucceed()
+	replayProducer.ExpectSendMessageAndSucceed()
+
+	o := &Output{
+		Producer:       producer,
+		logger:         testutils.NewLogger(t),
+		Config:         config,
+		router:         newTestTopicRouter(t),
+		keys:           newMessageKeys("", nil),
+		spool:          s,
+		replayProducer: replayProducer,
+	}
+	require.NoError(t, o.Start())
+	o.AddMetricSamples([]metrics.SampleContainer{sample, sample})
+	require.NoError(t, o.Stop())
+	assert.Equal(t, 0, s.pending())
+	assert.Equal(t, int64(0), s.droppedMessages())
+}
+
+func TestOutputLeavesSpoolWithoutDrain(t *testing.T) {
+	t.Parallel()
+	fs := fsext.NewMemMapFs()
+	config := NewConfig()
+	config.Spool = spoolConfig{Dir: null.StringFrom("/spool"), Drain: null.BoolFrom(false)}
+	s, err := openSpool(fs, config.Spool)
+	require.NoError(t, err)
+	require.NoError(t, s.append(newSpoolTestMessages(0, 3)...))
+
+	// the replay at Start sends the three messages at once, and fails
+	replayProducer := mocks.NewSyncProducer(t, nil)
+	replayProducer.ExpectSendMessageAndFail(errors.New("brokers are down"))
+	replayProducer.ExpectSendMessageAndSucceed()
+	replayProducer.ExpectSendMessageAndSucceed()
+	o := &Output{
+		Producer:       mocks.NewAsyncProducer(t, nil),
+		logger:         testutils.NewLogger(t),
+		Config:         config,
+		router:         newTestTopicRouter(t),
+		spool:          s,
+		replayProducer: replayProducer,
+	}
+	require.NoError(t, o.Start())
+	require.NoError(t, o.Stop())
+
+	s, err = openSpool(fs, config.Spool)
+	require.NoError(t, err)
+	assert.Equal(t, 3, s.pending())
+}
+
+func TestOutputSpoolsOnlyRetriableFailures(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("my_metric", metrics.Counter)
+	require.NoError(t, err)
+	sample := metrics.Sample{
+		TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()},
+		Value:      1,
+	}
+
+	fs := fsext.NewMemMapFs()
+	config := NewConfig()
+	config.Topic = null.StringFrom("my_topic")
+	config.LogError = null.BoolFrom(false)
+	config.Spool = spoolConfig{Dir: null.StringFrom("/spool"), Drain: null.BoolFrom(false)}
+	s, err := openSpool(fs, config.Spool)
+	require.NoError(t, err)
+
+	producer := mocks.NewAsyncProducer(t, nil)
+	producer.ExpectInputAndFail(sarama.ErrMessageSizeTooLarge)
+	producer.ExpectInputAndFail(sarama.ErrOutOfBrokers)
+	o := &Output{
+		Producer:       producer,
+		logger:         testutils.NewLogger(t),
+		Config:         config,
+		router:         newTestTopicRouter(t),
+		keys:           newMessageKeys("", nil),
+		spool:          s,
+		replayProducer: mocks.NewSyncProducer(t, nil),
+	}
+	require.NoError(t, o.Start())
+	o.AddMetricSamples([]metrics.SampleContainer{sample, sample})
+	require.NoError(t, o.Stop())
+
+	s, err = openSpool(fs, config.Spool)
+	require.NoError(t, err)
+	assert.Equal(t, 1, s.pending())
+}
@@ -0,0 +1,253 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.k6.io/k6/lib/types"
+	"go.k6.io/k6/output"
+	"gopkg.in/guregu/null.v3"
+)
+
+const (
+	defaultStopTestWindow      = time.Minute
+	defaultStopTestMinMessages = 10
+
+	// failureBucketWidth is the precision of the failure rate window.
+	failureBucketWidth = time.Second
+)
+
+type stopTestConfig struct {
+	ConsecutiveFailures null.Int           `json:"consecutiveFailures" envconfig:"K6_KAFKA_STOP_TEST_CONSECUTIVE_FAILURES"`
+	FailureRate         null.Float         `json:"failureRate" envconfig:"K6_KAFKA_STOP_TEST_FAILURE_RATE"`
+	Window              types.NullDuration `json:"window" envconfig:"K6_KAFKA_STOP_TEST_WINDOW"`
+	MinMessages         null.Int           `json:"minMessages" envconfig:"K6_KAFKA_STOP_TEST_MIN_MESSAGES"`
+}
+
+func (c stopTestConfig) Apply(cfg stopTestConfig) stopTestConfig {
+	if cfg.ConsecutiveFailures.Valid {
+		c.ConsecutiveFailures = cfg.ConsecutiveFailures
+	}
+	if cfg.FailureRate.Valid {
+		c.FailureRate = cfg.FailureRate
+	}
+	if cfg.Window.Valid {
+		c.Window = cfg.Window
+	}
+	if cfg.MinMessages.Valid {
+		c.MinMessages = cfg.MinMessages
+	}
+	return c
+}
+
+// stopTestParseMap parses a map[string]interface{} into a stopTestConfig
+func stopTestParseMap(m map[string]interface{}) (stopTestConfig, error) {
+	c := stopTestConfig{}
+	if v, ok := m["consecutiveFailures"].(int64); ok {
+		c.ConsecutiveFailures = null.IntFrom(v)
+		delete(m, "consecutiveFailures")
+	}
+	switch v := m["failureRate"].(type) {
+	case int64:
+		c.FailureRate = null.FloatFrom(float64(v))
+		delete(m, "failureRate")
+	case string:
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return c, fmt.Errorf("invalid stopTest.failureRate (%s): %w", v, err)
+		}
+		c.FailureRate = null.FloatFrom(rate)
+		delete(m, "failureRate")
+	}
+	if v, ok := m["window"].(string); ok {
+		if err := c.Window.UnmarshalText([]byte(v)); err != nil {
+			return c, err
+		}
+		delete(m, "window")
+	}
+	if v, ok := m["minMessages"].(int64); ok {
+		c.MinMessages = null.IntFrom(v)
+		delete(m, "minMessages")
+	}
+	if len(m) > 0 {
+		return c, errors.New("Unknown or unparsed options '" + mapToString(m) + "'")
+	}
+	return c, nil
+}
+
+func (c Config) validateStopTest() error {
+	if c.StopTest.ConsecutiveFailures.Valid && c.StopTest.ConsecutiveFailures.Int64 <= 0 {
+		return fmt.Errorf("stopTest.consecutiveFailures should be positive but was %d",
+			c.StopTest.ConsecutiveFailures.Int64)
+	}
+	if !c.StopTest.FailureRate.Valid {
+		if c.StopTest.Window.Valid || c.StopTest.MinMessages.Valid {
+			return errors.New("stopTest.window and stopTest.minMessages require stopTest.failureRate")
+		}
+		return nil
+	}
+	if rate := c.StopTest.FailureRate.Float64; rate <= 0 || rate >= 100 {
+		return fmt.Errorf("stopTest.failureRate should be a percentage between 0 and 100 but was %g", rate)
+	}
+	if c.StopTest.Window.Valid && time.Duration(c.StopTest.Window.Duration) < failureBucketWidth {
+		return fmt.Errorf("stopTest.window should be at least %s but was %s",
+			failureBucketWidth, c.StopTest.Window.Duration)
+	}
+	if c.StopTest.MinMessages.Valid && c.StopTest.MinMessages.Int64 <= 0 {
+		return fmt.Errorf("stopTest.minMessages should be positive but was %d", c.StopTest.MinMessages.Int64)
+	}
+	return nil
+}
+
+type failureBucket struct {
+	start    time.Time
+	messages int64
+	failures int64
+}
+
+// failureTracker follows the outcome of the deliveries, to tell when the test
+// run should be stopped because they keep failing. A nil failureTracker never
+// stops the test run.
+type failureTracker struct {
+	consecutiveLimit int64
+	rateLimit        float64
+	window           time.Duration
+	minMessages      int64
+	now              func() time.Time
+
+	mu          sync.Mutex
+	consecutive int64
+	buckets     []failureBucket
+	tripped     bool
+}
+
+// newFailureTracker returns the tracker of the stopTest policy, nil if there's
+// no policy.
+func newFailureTracker(c stopTestConfig) *failureTracker {
+	if !c.ConsecutiveFailures.Valid && !c.FailureRate.Valid {
+		return nil
+	}
+	t := &failureTracker{
+		consecutiveLimit: c.ConsecutiveFailures.Int64,
+		rateLimit:        c.FailureRate.Float64,
+		window:           defaultStopTestWindow,
+		minMessages:      defaultStopTestMinMessages,
+		now:              time.Now,
+	}
+	if c.Window.Valid {
+		t.window = time.Duration(c.Window.Duration)
+	}
+	if c.MinMessages.Valid {
+		t.minMessages = c.MinMessages.Int64
+	}
+	return t
+}
+
+// record records the outcome of a delivery, a nil deliveryErr being a success.
+// It returns why the test run should stop the first time the policy trips.
+func (t *failureTracker) record(deliveryErr error) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.tripped {
+		return nil
+	}
+	failed := deliveryErr != nil
+	if failed {
+		t.consecutive++
+	} else {
+		t.consecutive = 0
+	}
+	if t.consecutiveLimit > 0 && t.consecutive >= t.consecutiveLimit {
+		t.tripped = true
+		return fmt.Errorf("%d messages in a row couldn't be delivered to Kafka, the last one because of: %w",
+			t.consecutive, deliveryErr)
+	}
+	if t.rateLimit <= 0 {
+		return nil
+	}
+
+	messages, failures := t.countWindow(failed)
+	if messages < t.minMessages {
+		return nil
+	}
+	if rate := float64(failures) * 100 / float64(messages); rate > t.rateLimit {
+		t.tripped = true
+		return fmt.Errorf("%.1f%% of the %d messages of the last %s couldn't be delivered to Kafka, "+
+			"more than the %g%% of stopTest.failureRate", rate, messages, t.window, t.rateLimit)
+	}
+	return nil
+}
+
+// countWindow adds the delivery to the current bucket, drops the buckets that
+// are out of the window, and returns the messages and failures of the window.
+func (t *failureTracker) countWindow(failed bool) (int64, int64) {
+	now := t.now()
+	start := now.Truncate(failureBucketWidth)
+	if len(t.buckets) == 0 || t.buckets[len(t.buckets)-1].start.Before(start) {
+		t.buckets = append(t.buckets, failureBucket{start: start})
+	}
+	current := &t.buckets[len(t.buckets)-1]
+	current.messages++
+	if failed {
+		current.failures++
+	}
+
+	windowStart := now.Add(-t.window)
+	for len(t.buckets) > 0 && !t.buckets[0].start.After(windowStart) {
+		t.buckets = t.buckets[1:]
+	}
+	var messages, failures int64
+	for _, bucket := range t.buckets {
+		messages += bucket.messages
+		failures += bucket.failures
+	}
+	return messages, failures
+}
+
+var _ output.WithTestRunStop = &Output{}
+
+// SetTestRunStopCallback receives the function that stops the test run, which
+// is called when the stopTest policy trips.
+func (o *Output) SetTestRunStopCallback(stop func(error)) {
+	o.testRunStop = stop
+}
+
+// recordDelivery feeds the outcome of a delivery to the stopTest policy, and
+// stops the test run when it trips.
+func (o *Output) recordDelivery(deliveryErr error) {
+	stopErr := o.failures.record(deliveryErr)
+	if stopErr == nil {
+		return
+	}
+	o.logger.WithError(stopErr).Error("Kafka: Stopping the test run")
+	if o.testRunStop != nil {
+		o.testRunStop(stopErr)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/lib/testutils"
+	"go.k6.io/k6/lib/types"
+	"go.k6.io/k6/metrics"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestFailureTrackerConsecutiveFailures(t *testing.T) {
+	t.Parallel()
+	tracker := newFailureTracker(stopTestConfig{ConsecutiveFailures: null.IntFrom(3)})
+	assert.NoError(t, tracker.record(sarama.ErrOutOfBrokers))
+	assert.NoError(t, tracker.record(sarama.ErrOutOfBrokers))
+	assert.NoError(t, tracker.record(nil))
+	assert.NoError(t, tracker.record(sarama.ErrOutOfBrokers))
+	assert.NoError(t, tracker.record(sarama.ErrOutOfBrokers))
+
+	err := tracker.record(sarama.ErrOutOfBrokers)
+	require.ErrorIs(t, err, sarama.ErrOutOfBrokers)
+	assert.Contains(t, err.Error(), "3 messages in a row couldn't be delivered to Kafka")
+
+	// the policy only trips once
+	assert.NoError(t, tracker.record(sarama.ErrOutOfBrokers))
+
+	assert.Nil(t, newFailureTracker(stopTestConfig{}))
+	assert.NoError(t, (*failureTracker)(nil).record(sarama.ErrOutOfBrokers))
+}
+
+func TestFailureTrackerFailureRate(t *testing.T) {
+	t.Parallel()
+	clock := &testClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	tracker := newFailureTracker(stopTestConfig{
+		FailureRate: null.FloatFrom(50),
+		Window:      types.NullDurationFrom(10 * time.Second),
+		MinMessages: null.IntFrom(4),
+	})
+	tracker.now = clock.Now
+
+	// too few messages to tell
+	assert.NoError(t, tracker.record(sarama.ErrOutOfBrokers))
+	assert.NoError(t, tracker.record(sarama.ErrOutOfBrokers))
+	assert.NoError(t, tracker.record(nil))
+
+	// the failures are out of the window by now, 1 of 4 messages failed
+	clock.now = clock.now.Add(11 * time.Second)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, tracker.record(nil))
+	}
+	assert.NoError(t, tracker.record(sarama.ErrOutOfBrokers))
+
+	clock.now = clock.now.Add(5 * time.Second)
+	assert.NoError(t, tracker.record(sarama.ErrOutOfBrokers))
+	assert.NoError(t, tracker.record(sarama.ErrOutOfBrokers))
+	err := tracker.record(sarama.ErrOutOfBrokers)
+	require.Error(t, err)
+	assert.Equal(t, "57.1% of the 7 messages of the last 10s couldn't be delivered to Kafka, "+
+		"more than the 50% of stopTest.failureRate", err.Error())
+}
+
+func TestOutputStopsTestRun(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	metric, err := registry.NewMetric("my_metric", metrics.Counter)
+	require.NoError(t, err)
+	sample := metrics.Sample{
+		TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()},
+		Value:      1,
+	}
+
+	producer := mocks.NewAsyncProducer(t, nil)
+	for i := 0; i < 3; i++ {
+		producer.ExpectInputAndFail(sarama.ErrLeaderNotAvailable)
+	}
+	config := NewConfig()
+	config.Topic = null.StringFrom("my_topic")
+	config.StopTest.ConsecutiveFailures = null.IntFrom(2)
+	o := &Output{
+		Producer: producer,
+		logger:   testutils.NewLogger(t),
+		Config:   config,
+		router:   newTestTopicRouter(t),
+		keys:     newMessageKeys("", nil),
+	}
+	stopped := make(chan error, 1)
+	o.SetTestRunStopCallback(func(err error) { stopped <- err })
+
+	require.NoError(t, o.Start())
+	o.AddMetricSamples([]metrics.SampleContainer{sample, sample, sample})
+	require.NoError(t, o.Stop())
+
+	select {
+	case err := <-stopped:
+		require.ErrorIs(t, err, sarama.ErrLeaderNotAvailable)
+		assert.Contains(t, err.Error(), "2 messages in a row couldn't be delivered to Kafka")
+	default:
+		t.Fatal("the test run wasn't stopped")
+	}
+	assert.Empty(t, stopped)
+}
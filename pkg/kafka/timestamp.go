@@ -0,0 +1,52 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2021 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"time"
+
+	"go.k6.io/k6/metrics"
+)
+
+// The supported values of the timestamp option.
+const (
+	timestampNone   = "none"
+	timestampNewest = "newest"
+	timestampOldest = "oldest"
+)
+
+// messageTimestamp returns the timestamp of a message with the samples, the
+// time of the newest or oldest one depending on mode. A zero time, which lets
+// the producer stamp the message, is returned if mode is none.
+func messageTimestamp(mode string, samples []metrics.Sample) time.Time {
+	var timestamp time.Time
+	if mode != timestampNewest && mode != timestampOldest {
+		return timestamp
+	}
+	for _, sample := range samples {
+		if timestamp.IsZero() ||
+			(mode == timestampNewest && sample.Time.After(timestamp)) ||
+			(mode == timestampOldest && sample.Time.Before(timestamp)) {
+			timestamp = sample.Time
+		}
+	}
+	return timestamp
+}
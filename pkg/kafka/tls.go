@@ -0,0 +1,133 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"go.k6.io/k6/lib/fsext"
+)
+
+// tlsVersions are the supported values of the tlsMinVersion option.
+var tlsVersions = map[string]uint16{ //nolint:gochecknoglobals
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (c Config) validateTLS() error {
+	if !c.SSL.Bool {
+		switch {
+		case c.CAFile.Valid, c.CertFile.Valid, c.KeyFile.Valid, c.ServerName.Valid, c.TLSMinVersion.Valid:
+			return errors.New("caFile, certFile, keyFile, serverName and tlsMinVersion require ssl=true")
+		}
+		return nil
+	}
+	if c.CertFile.Valid != c.KeyFile.Valid {
+		return errors.New("certFile and keyFile should be set together")
+	}
+	if (c.KeyPassphrase.Valid || c.KeyPassphraseFile.Valid) && !c.KeyFile.Valid {
+		return errors.New("keyPassphrase and keyPassphraseFile require keyFile")
+	}
+	if _, ok := tlsVersions[c.TLSMinVersion.String]; c.TLSMinVersion.Valid && !ok {
+		return fmt.Errorf("invalid tlsMinVersion (%s), it should be one of 1.0, 1.1, 1.2 or 1.3", c.TLSMinVersion.String)
+	}
+	return nil
+}
+
+// newTLSConfig returns the TLS config to connect to the brokers with, using the
+// configured CA bundle and client certificate, if any.
+func newTLSConfig(c Config, fs fsext.Fs) (*tls.Config, error) {
+	// #nosec G402
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipTLSVerify.Bool,
+		ServerName:         c.ServerName.String,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if c.TLSMinVersion.Valid {
+		tlsConfig.MinVersion = tlsVersions[c.TLSMinVersion.String]
+	}
+
+	if c.CAFile.Valid {
+		caPEM, err := fsext.ReadFile(fs, c.CAFile.String)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read caFile: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("caFile (%s) doesn't have any PEM certificate", c.CAFile.String)
+		}
+	}
+
+	if c.CertFile.Valid {
+		passphrase, err := readSecret(fs, c.KeyPassphrase, c.KeyPassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		certificate, err := loadClientCertificate(fs, c.CertFile.String, c.KeyFile.String, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// loadClientCertificate loads the PEM client certificate and its key, which is
+// decrypted with passphrase when it's encrypted.
+func loadClientCertificate(fs fsext.Fs, certFile, keyFile, passphrase string) (tls.Certificate, error) {
+	certPEM, err := fsext.ReadFile(fs, certFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("couldn't read certFile: %w", err)
+	}
+	keyPEM, err := fsext.ReadFile(fs, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("couldn't read keyFile: %w", err)
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return tls.Certificate{}, fmt.Errorf("keyFile (%s) doesn't have a PEM key", keyFile)
+	}
+	// only the legacy PEM encryption (Proc-Type: 4,ENCRYPTED) can be decrypted
+	// with the standard library
+	if x509.IsEncryptedPEMBlock(block) { //nolint:staticcheck
+		if passphrase == "" {
+			return tls.Certificate{}, fmt.Errorf("keyFile (%s) is encrypted but no keyPassphrase is set", keyFile)
+		}
+		der, decryptErr := x509.DecryptPEMBlock(block, []byte(passphrase)) //nolint:staticcheck
+		if decryptErr != nil {
+			return tls.Certificate{}, fmt.Errorf("couldn't decrypt keyFile: %w", decryptErr)
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	}
+
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("couldn't load the client certificate: %w", err)
+	}
+	return certificate, nil
+}
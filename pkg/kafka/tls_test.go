@@ -0,0 +1,178 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/lib/fsext"
+	"gopkg.in/guregu/null.v3"
+)
+
+// testCertificate is a certificate and its key, PEM encoded.
+type testCertificate struct {
+	cert, key []byte
+	parsed    *x509.Certificate
+	signer    *ecdsa.PrivateKey
+}
+
+// newTestCertificate creates a certificate signed by parent, or a self-signed
+// CA when parent is nil.
+func newTestCertificate(t *testing.T, name string, parent *testCertificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parentCert, parentKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parentCert, parentKey = parent.parsed, parent.signer
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	parsed, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCertificate{
+		cert:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		parsed: parsed,
+		signer: key,
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	t.Parallel()
+	ca := newTestCertificate(t, "k6-ca", nil)
+	client := newTestCertificate(t, "k6-client", ca)
+
+	keyDER, err := x509.MarshalECPrivateKey(client.signer)
+	require.NoError(t, err)
+	//nolint:staticcheck // the legacy PEM encryption is the one that's supported
+	encryptedBlock, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", keyDER, []byte("secret"), x509.PEMCipherAES256)
+	require.NoError(t, err)
+
+	fs := fsext.NewMemMapFs()
+	require.NoError(t, fsext.WriteFile(fs, "/certs/ca.pem", ca.cert, 0o600))
+	require.NoError(t, fsext.WriteFile(fs, "/certs/client.pem", client.cert, 0o600))
+	require.NoError(t, fsext.WriteFile(fs, "/certs/client.key", client.key, 0o600))
+	require.NoError(t, fsext.WriteFile(fs, "/certs/client-encrypted.key", pem.EncodeToMemory(encryptedBlock), 0o600))
+
+	config := NewConfig()
+	config.SSL = null.BoolFrom(true)
+	config.CAFile = null.StringFrom("/certs/ca.pem")
+	config.CertFile = null.StringFrom("/certs/client.pem")
+	config.KeyFile = null.StringFrom("/certs/client.key")
+	config.ServerName = null.StringFrom("kafka.test")
+	config.TLSMinVersion = null.StringFrom("1.3")
+	tlsConfig, err := newTLSConfig(config, fs)
+	require.NoError(t, err)
+	assert.Equal(t, "kafka.test", tlsConfig.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	assert.NotNil(t, tlsConfig.RootCAs)
+
+	config.KeyFile = null.StringFrom("/certs/client-encrypted.key")
+	_, err = newTLSConfig(config, fs)
+	require.ErrorContains(t, err, "is encrypted but no keyPassphrase is set")
+
+	config.KeyPassphrase = null.StringFrom("wrong")
+	_, err = newTLSConfig(config, fs)
+	require.ErrorContains(t, err, "couldn't decrypt keyFile")
+
+	config.KeyPassphrase = null.StringFrom("secret")
+	tlsConfig, err = newTLSConfig(config, fs)
+	require.NoError(t, err)
+	assert.Len(t, tlsConfig.Certificates, 1)
+
+	config.CAFile = null.StringFrom("/certs/client.key")
+	_, err = newTLSConfig(config, fs)
+	require.ErrorContains(t, err, "doesn't have any PEM certificate")
+}
+
+func TestNewProducerMutualTLS(t *testing.T) {
+	t.Parallel()
+	ca := newTestCertificate(t, "k6-ca", nil)
+	server := newTestCertificate(t, "kafka.test", ca)
+	client := newTestCertificate(t, "k6-client", ca)
+
+	serverCertificate, err := tls.X509KeyPair(server.cert, server.key)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.parsed)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})
+	require.NoError(t, err)
+
+	broker := sarama.NewMockBrokerListener(t, 1, listener)
+	defer broker.Close()
+	metadata := new(sarama.MetadataResponse)
+	metadata.AddBroker(broker.Addr(), broker.BrokerID())
+	metadata.AddTopicPartition("my_topic", 0, broker.BrokerID(), nil, nil, nil, sarama.ErrNoError)
+	broker.Returns(metadata)
+
+	fs := fsext.NewMemMapFs()
+	require.NoError(t, fsext.WriteFile(fs, "/certs/ca.pem", ca.cert, 0o600))
+	require.NoError(t, fsext.WriteFile(fs, "/certs/client.pem", client.cert, 0o600))
+	require.NoError(t, fsext.WriteFile(fs, "/certs/client.key", client.key, 0o600))
+
+	// TLS without any SASL mechanism
+	config := NewConfig()
+	config.Brokers = []string{broker.Addr()}
+	config.Version = null.StringFrom("0.8.2.0")
+	config.SSL = null.BoolFrom(true)
+	config.CAFile = null.StringFrom("/certs/ca.pem")
+	config.CertFile = null.StringFrom("/certs/client.pem")
+	config.KeyFile = null.StringFrom("/certs/client.key")
+	config.ServerName = null.StringFrom("kafka.test")
+	producer, err := newProducer(config, fs, nil)
+	require.NoError(t, err)
+	require.NoError(t, producer.Close())
+}
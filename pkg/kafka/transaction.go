@@ -0,0 +1,107 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package kafka
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+)
+
+// defaultTransactionalIDPrefix is the prefix of the transactional ID when none
+// is configured.
+const defaultTransactionalIDPrefix = "k6"
+
+func (c Config) validateTransactional() error {
+	if !c.Transactional.Bool {
+		return nil
+	}
+	if c.Idempotent.Valid && !c.Idempotent.Bool {
+		return errors.New("transactional requires idempotent")
+	}
+	if c.TransactionalIDPrefix.Valid && c.TransactionalIDPrefix.String == "" {
+		return errors.New("transactionalIDPrefix can't be empty")
+	}
+	return nil
+}
+
+// transactionalID returns the transactional.id of the producer, unique to the
+// test run so concurrent runs don't fence each other out.
+func (c Config) transactionalID() string {
+	prefix := defaultTransactionalIDPrefix
+	if c.TransactionalIDPrefix.Valid {
+		prefix = c.TransactionalIDPrefix.String
+	}
+	return prefix + "-" + c.TestRunID.String
+}
+
+// produceInTransaction sends the messages of a flush in a single transaction,
+// so read_committed consumers see either all of them or none. The transaction
+// is aborted if it can't be committed.
+func (o *Output) produceInTransaction(messages []*sarama.ProducerMessage) error {
+	for _, message := range messages {
+		o.stats.produced(message)
+	}
+	if err := o.Producer.BeginTxn(); err != nil {
+		o.countTransaction(messages, err)
+		return err
+	}
+	for _, message := range messages {
+		o.Producer.Input() <- message
+	}
+	if err := o.Producer.CommitTxn(); err != nil {
+		o.countTransaction(messages, err)
+		o.logger.WithError(err).Warn("Kafka: Failed to commit the transaction, aborting it...")
+		if abortErr := o.Producer.AbortTxn(); abortErr != nil {
+			return fmt.Errorf("%w, and the transaction couldn't be aborted: %s", err, abortErr.Error())
+		}
+		return err
+	}
+	o.countTransaction(messages, nil)
+	return nil
+}
+
+// countTransaction counts the messages of a transaction as acked once it's
+// committed, and as failed otherwise, even those the brokers acked, as
+// read_committed consumers never see them.
+func (o *Output) countTransaction(messages []*sarama.ProducerMessage, txnErr error) {
+	for _, message := range messages {
+		if txnErr == nil {
+			o.stats.acked(message)
+		} else {
+			o.stats.failed(message)
+		}
+		o.recordDelivery(txnErr)
+	}
+}
+
+// abortPendingTransaction aborts the transaction a failed flush may have left
+// open, so the producer can be closed cleanly.
+func (o *Output) abortPendingTransaction() {
+	if !o.Producer.IsTransactional() || o.Producer.TxnStatus()&sarama.ProducerTxnFlagInTransaction == 0 {
+		return
+	}
+	o.logger.Debug("Kafka: Aborting the pending transaction...")
+	if err := o.Producer.AbortTxn(); err != nil {
+		o.logger.WithError(err).Error("Kafka: Failed to abort the pending transaction")
+	}
+}